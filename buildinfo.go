@@ -0,0 +1,36 @@
+package prometheusmetrics
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var labelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// validLabelName reports whether name is a legal, non reserved Prometheus
+// label name.
+func validLabelName(name string) bool {
+	return labelNameRE.MatchString(name) && !strings.HasPrefix(name, "__")
+}
+
+func (c *PrometheusConfig) registerBuildInfo() error {
+	labels := prometheus.Labels{}
+	for k, v := range c.constLabels {
+		labels[k] = v
+	}
+	for k, v := range c.buildInfo {
+		labels[k] = v
+	}
+	name, help := "build_info", c.buildInfoHelp
+	if c.buildInfoUnit != "" {
+		name += "_" + c.buildInfoUnit
+	}
+	if help == "" {
+		help = "Build information of the exporting program, always 1."
+	}
+	g := prometheus.NewGauge(prometheus.GaugeOpts(c.opts(name, help, labels)))
+	g.Set(1)
+	return c.registerStatic(g)
+}
@@ -0,0 +1,53 @@
+package prometheusmetrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildInfo(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	_, err := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheusRegistry,
+		BuildInfo(prometheus.Labels{"version": "1.2.3", "revision": "abc"}))
+	assert.NoError(t, err)
+
+	families, _ := prometheusRegistry.Gather()
+	assert.Equal(t, 1, len(families))
+	assert.Equal(t, "test_subsys_build_info", families[0].GetName())
+	m := families[0].GetMetric()[0]
+	assert.Equal(t, 1.0, m.GetGauge().GetValue())
+	assert.Equal(t, 2, len(m.GetLabel()))
+}
+
+func TestBuildInfoHelpAndUnit(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	_, err := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheusRegistry,
+		BuildInfo(prometheus.Labels{"version": "1.2.3"}), BuildInfoHelp("Version of the service."), BuildInfoUnit("timestamp_seconds"))
+	assert.NoError(t, err)
+
+	families, _ := prometheusRegistry.Gather()
+	assert.Equal(t, 1, len(families))
+	assert.Equal(t, "test_subsys_build_info_timestamp_seconds", families[0].GetName())
+	assert.Equal(t, "Version of the service.", families[0].GetHelp())
+
+	_, err = NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry(),
+		BuildInfo(prometheus.Labels{"version": "1.2.3"}), BuildInfoUnit("bad-unit"))
+	assert.Error(t, err, "invalid unit should be rejected")
+}
+
+func TestBuildInfoRequiresVersion(t *testing.T) {
+	_, err := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry(),
+		BuildInfo(prometheus.Labels{"version": "", "revision": "abc"}))
+	assert.Error(t, err, "empty version label should be rejected")
+
+	_, err = NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry(),
+		BuildInfo(prometheus.Labels{"version": "1.2.3"}, "version", "revision"))
+	assert.Error(t, err, "missing required label should be rejected")
+
+	_, err = NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry(),
+		BuildInfo(prometheus.Labels{"version": "1.2.3", "bad-label": "x"}))
+	assert.Error(t, err, "invalid label name should be rejected")
+}
@@ -0,0 +1,77 @@
+package prometheusmetrics
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// FlushingGatherer returns a gatherer flushing the registry before every
+// gather, so scrapes always see fresh values. Gathers within window of the
+// last flush, e.g. concurrent scrapes, reuse that flush. A failed flush does
+// not fail the gather, the failures are reported through OnError.
+func (c *PrometheusConfig) FlushingGatherer(window time.Duration) prometheus.Gatherer {
+	return &flushingGatherer{c: c, window: window}
+}
+
+type flushingGatherer struct {
+	c      *PrometheusConfig
+	window time.Duration
+
+	mu        sync.Mutex
+	lastFlush time.Time
+}
+
+func (g *flushingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	gatherer := g.c.Gatherer()
+	if gatherer == nil {
+		return nil, errors.New("prometheus registry is not a gatherer")
+	}
+	g.mu.Lock()
+	if g.lastFlush.IsZero() || time.Since(g.lastFlush) >= g.window {
+		g.c.UpdatePrometheusMetricsOnce()
+		g.lastFlush = time.Now()
+	}
+	g.mu.Unlock()
+	return gatherer.Gather()
+}
+
+// Handler returns an http.Handler serving the exported metrics on /metrics.
+// Metrics are gathered from the registry the provider registers in, or from
+// the default Prometheus gatherer if that registry cannot be gathered from.
+// With HealthEndpoint enabled it also serves /healthz.
+func (c *PrometheusConfig) Handler() http.Handler {
+	gatherer := c.Gatherer()
+	if gatherer == nil {
+		gatherer = prometheus.DefaultGatherer
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	if c.healthEndpoint {
+		mux.HandleFunc("/healthz", c.serveHealth)
+	}
+	return mux
+}
+
+// ListenAndServe serves Handler on the given address.
+func (c *PrometheusConfig) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, c.Handler())
+}
+
+// serveHealth responds with 200 if the last flush succeeded or there was no
+// flush yet, and 503 otherwise.
+func (c *PrometheusConfig) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&c.lastFlushOK) == 1 {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("last flush failed\n"))
+}
@@ -0,0 +1,86 @@
+package prometheusmetrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlerMetrics(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+	metricsRegistry.Register("counter", metrics.NewCounter())
+	pClient.UpdatePrometheusMetricsOnce()
+
+	server := httptest.NewServer(pClient.Handler())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, strings.Contains(string(body), "test_subsys_counter 0"), "metrics should be served, got %s", body)
+
+	resp, err = http.Get(server.URL + "/healthz")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "health endpoint should be opt-in")
+}
+
+func TestHandlerHealth(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), HealthEndpoint(true))
+	server := httptest.NewServer(pClient.Handler())
+	defer server.Close()
+	status := func() int {
+		resp, err := http.Get(server.URL + "/healthz")
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, status(), "the provider should be healthy before the first flush")
+
+	metricsRegistry.Register("counter", metrics.NewCounter())
+	pClient.UpdatePrometheusMetricsOnce()
+	assert.Equal(t, http.StatusOK, status(), "successful flush should be healthy")
+
+	metricsRegistry.Register("healthcheck", metrics.NewHealthcheck(func(metrics.Healthcheck) {}))
+	pClient.UpdatePrometheusMetricsOnce()
+	assert.Equal(t, http.StatusServiceUnavailable, status(), "failed flush should be unhealthy")
+}
+
+func TestFlushingGatherer(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), SelfMetrics(true))
+	gauge := metrics.NewGauge()
+	metricsRegistry.Register("gauge", gauge)
+	gauge.Update(5)
+
+	gatherer := pClient.FlushingGatherer(time.Hour)
+	families, err := gatherer.Gather()
+	assert.NoError(t, err)
+	var value float64
+	for _, mf := range families {
+		if mf.GetName() == "test_subsys_gauge" {
+			value = mf.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	assert.Equal(t, 5.0, value, "the gather should flush first")
+
+	gauge.Update(6)
+	gatherer.Gather()
+	assert.Equal(t, 1.0, testutil.ToFloat64(pClient.self.flushMetrics), "gathers within the window should not flush again")
+	assert.Equal(t, 5.0, pClient.ExportedValues()["test_subsys_gauge"])
+}
@@ -0,0 +1,83 @@
+package prometheusmetrics
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// histogramCollector exposes the sample of a go-metrics histogram as a
+// native Prometheus histogram. The bucket counts are recomputed on every
+// flush and served as a const metric on collection.
+type histogramCollector struct {
+	desc    *prometheus.Desc
+	buckets []float64
+
+	mu     sync.Mutex
+	count  uint64
+	sum    float64
+	counts map[float64]uint64
+}
+
+func newHistogramCollector(desc *prometheus.Desc, buckets []float64) *histogramCollector {
+	sorted := make([]float64, len(buckets))
+	copy(sorted, buckets)
+	sort.Float64s(sorted)
+	return &histogramCollector{
+		desc:    desc,
+		buckets: sorted,
+		counts:  make(map[float64]uint64, len(sorted)),
+	}
+}
+
+// cumulativeBuckets counts for every upper bound the values less than or
+// equal to it, as the le buckets of a Prometheus histogram do. The bounds
+// must be sorted in increasing order.
+func cumulativeBuckets(values []int64, bounds []float64) map[float64]uint64 {
+	sorted := make([]int64, len(values))
+	copy(sorted, values)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	counts := make(map[float64]uint64, len(bounds))
+	var n int
+	for _, upper := range bounds {
+		for n < len(sorted) && float64(sorted[n]) <= upper {
+			n++
+		}
+		counts[upper] = uint64(n)
+	}
+	return counts
+}
+
+// update replaces the exported state with the given sample values. The
+// count, and so the implicit +Inf bucket, is the number of sampled values
+// for the buckets to stay consistent with it.
+func (h *histogramCollector) update(values []int64) {
+	counts := cumulativeBuckets(values, h.buckets)
+	var sum float64
+	for _, v := range values {
+		sum += float64(v)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.count = uint64(len(values))
+	h.sum = sum
+	h.counts = counts
+}
+
+func (h *histogramCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.desc
+}
+
+func (h *histogramCollector) Collect(ch chan<- prometheus.Metric) {
+	h.mu.Lock()
+	buckets := make(map[float64]uint64, len(h.buckets))
+	for _, upper := range h.buckets {
+		buckets[upper] = h.counts[upper]
+	}
+	m := prometheus.MustNewConstHistogram(h.desc, h.count, h.sum, buckets)
+	h.mu.Unlock()
+	ch <- m
+}
@@ -0,0 +1,150 @@
+package prometheusmetrics
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogramBucketsPerName(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), HistogramBuckets(map[string][]float64{
+		"db": {1, 5, 10},
+	}))
+	db := metrics.NewHistogram(metrics.NewUniformSample(100))
+	api := metrics.NewHistogram(metrics.NewUniformSample(100))
+	metricsRegistry.Register("db", db)
+	metricsRegistry.Register("api", api)
+	db.Update(3)
+	api.Update(3)
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, err := prometheusRegistry.Gather()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(families), "expected both histograms to be exported")
+	bounds := map[string][]float64{}
+	for _, mf := range families {
+		for _, b := range mf.GetMetric()[0].GetHistogram().GetBucket() {
+			bounds[mf.GetName()] = append(bounds[mf.GetName()], b.GetUpperBound())
+		}
+	}
+	assert.Equal(t, []float64{1, 5, 10}, bounds["test_subsys_db"], "db should use its own buckets")
+	assert.Equal(t, prometheus.DefBuckets, bounds["test_subsys_api"], "api should use the default buckets")
+}
+
+func TestHistogramPercentilesAndVariance(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		Percentiles(0.5, 0.99, 0.999), HistogramVariance(true))
+	h := metrics.NewHistogram(metrics.NewUniformSample(2000))
+	metricsRegistry.Register("latency", h)
+	for i := int64(1); i <= 1000; i++ {
+		h.Update(i)
+	}
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(families))
+	assert.Equal(t, "test_subsys_latency", families[0].GetName())
+	quantiles := map[string]float64{}
+	for _, m := range families[0].GetMetric() {
+		quantiles[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+	}
+	snapshot := h.Snapshot()
+	assert.Equal(t, map[string]float64{
+		"0.5":   snapshot.Percentile(0.5),
+		"0.99":  snapshot.Percentile(0.99),
+		"0.999": snapshot.Percentile(0.999),
+	}, quantiles)
+	assert.Equal(t, "test_subsys_latency_variance", families[1].GetName())
+	assert.Equal(t, snapshot.Variance(), families[1].GetMetric()[0].GetGauge().GetValue())
+}
+
+func TestEmptyPercentilesAsNaN(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		Percentiles(0.5, 0.99), EmptyPercentilesAsNaN(true))
+	h := metrics.NewHistogram(metrics.NewUniformSample(100))
+	metricsRegistry.Register("latency", h)
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(families[0].GetMetric()))
+	for _, m := range families[0].GetMetric() {
+		assert.True(t, math.IsNaN(m.GetGauge().GetValue()), "percentile of an empty histogram should be NaN")
+	}
+
+	h.Update(7)
+	families, _ = pClient.FlushAndGather()
+	for _, m := range families[0].GetMetric() {
+		assert.Equal(t, 7.0, m.GetGauge().GetValue())
+	}
+}
+
+func TestCumulativeBuckets(t *testing.T) {
+	counts := cumulativeBuckets([]int64{7, 1, 3, 3, 12, 5}, []float64{1, 3, 5, 10})
+	assert.Equal(t, map[float64]uint64{1: 1, 3: 3, 5: 4, 10: 5}, counts)
+}
+
+func TestHistogramBucketsAreCumulative(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		HistogramBuckets(map[string][]float64{"latency": {100, 10, 50}}))
+	h := metrics.NewHistogram(metrics.NewUniformSample(100))
+	metricsRegistry.Register("latency", h)
+	for _, v := range []int64{5, 10, 20, 60, 70, 200} {
+		h.Update(v)
+	}
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	histogram := families[0].GetMetric()[0].GetHistogram()
+	var bounds []float64
+	var counts []uint64
+	for _, b := range histogram.GetBucket() {
+		bounds = append(bounds, b.GetUpperBound())
+		counts = append(counts, b.GetCumulativeCount())
+	}
+	assert.Equal(t, []float64{10, 50, 100}, bounds, "buckets should be le ordered")
+	assert.Equal(t, []uint64{2, 3, 5}, counts, "bucket counts should be cumulative")
+	assert.Equal(t, uint64(6), histogram.GetSampleCount(), "+Inf bucket should hold the total count")
+	assert.Equal(t, 365.0, histogram.GetSampleSum())
+}
+
+func TestDefaultHistogramBuckets(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		DefaultHistogramBuckets([]float64{10, 100}), HistogramBuckets(map[string][]float64{"db": {1}}))
+	api := metrics.NewHistogram(metrics.NewUniformSample(100))
+	db := metrics.NewHistogram(metrics.NewUniformSample(100))
+	metricsRegistry.Register("api", api)
+	metricsRegistry.Register("db", db)
+	for _, v := range []int64{5, 50, 500} {
+		api.Update(v)
+		db.Update(v)
+	}
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	bounds := map[string][]float64{}
+	for _, mf := range families {
+		assert.Equal(t, "HISTOGRAM", mf.GetType().String())
+		for _, b := range mf.GetMetric()[0].GetHistogram().GetBucket() {
+			bounds[mf.GetName()] = append(bounds[mf.GetName()], b.GetUpperBound())
+		}
+	}
+	assert.Equal(t, []float64{10, 100}, bounds["test_subsys_api"], "histograms without an entry should use the default buckets")
+	assert.Equal(t, []float64{1}, bounds["test_subsys_db"])
+
+	_, err = NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, DefaultHistogramBuckets(nil))
+	assert.Error(t, err)
+}
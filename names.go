@@ -0,0 +1,219 @@
+package prometheusmetrics
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NameStage transforms the namespace, subsystem and name of an exported
+// metric. Stages are chained by NamePipeline.
+type NameStage func(namespace, subsystem, name string) (string, string, string)
+
+// StripPrefixStage removes prefix from metric names starting with it.
+func StripPrefixStage(prefix string) NameStage {
+	return func(namespace, subsystem, name string) (string, string, string) {
+		return namespace, subsystem, strings.TrimPrefix(name, prefix)
+	}
+}
+
+// RenameStage replaces metric names found in names by their mapped name.
+func RenameStage(names map[string]string) NameStage {
+	return func(namespace, subsystem, name string) (string, string, string) {
+		if renamed, ok := names[name]; ok {
+			return namespace, subsystem, renamed
+		}
+		return namespace, subsystem, name
+	}
+}
+
+// SubsystemMapStage moves metrics whose name starts with one of the given
+// prefixes followed by a dot into the mapped subsystem, removing the prefix
+// from the name.
+func SubsystemMapStage(subsystems map[string]string) NameStage {
+	return func(namespace, subsystem, name string) (string, string, string) {
+		if i := strings.Index(name, "."); i > 0 {
+			if mapped, ok := subsystems[name[:i]]; ok {
+				return namespace, mapped, name[i+1:]
+			}
+		}
+		return namespace, subsystem, name
+	}
+}
+
+// NormalizeStage normalizes the namespace and subsystem with component and
+// the name with name.
+func NormalizeStage(component, name Normalizer) NameStage {
+	return func(namespace, subsystem, n string) (string, string, string) {
+		return component(namespace), component(subsystem), name(n)
+	}
+}
+
+var metricNameRE = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+
+func (c *PrometheusConfig) normalizeComponent(component string) string {
+	if c.componentNormalizer != nil {
+		return c.componentNormalizer(component)
+	}
+	if component == "" || metricNameRE.MatchString(component) {
+		return component
+	}
+	return c.keyNormalizer(component)
+}
+
+// validateComponents checks the normalized namespace and subsystem are valid
+// in Prometheus metric names.
+func (c *PrometheusConfig) validateComponents() error {
+	if namespace := c.promNamespace(); namespace != "" && !metricNameRE.MatchString(namespace) {
+		return fmt.Errorf("invalid namespace '%s'", namespace)
+	}
+	if subsystem := c.promSubsystem(); subsystem != "" && !metricNameRE.MatchString(subsystem) {
+		return fmt.Errorf("invalid subsystem '%s'", subsystem)
+	}
+	return nil
+}
+
+// promNamespace returns the namespace of exported Prometheus metrics.
+func (c *PrometheusConfig) promNamespace() string {
+	return c.namespace
+}
+
+// promSubsystem returns the subsystem of exported Prometheus metrics.
+func (c *PrometheusConfig) promSubsystem() string {
+	return c.subsystem
+}
+
+// promName holds the name components of the Prometheus metric exported for
+// a go-metrics metric.
+type promName struct {
+	namespace, subsystem, name string
+	fqName                     string
+}
+
+// promNames returns the namespace, subsystem and name component of the
+// Prometheus metric exported for name.
+func (c *PrometheusConfig) promNames(name string) (string, string, string) {
+	n := c.promName(name)
+	return n.namespace, n.subsystem, n.name
+}
+
+// nameCacheSize bounds the number of names whose exported names are cached.
+const nameCacheSize = 10000
+
+// promName returns the name components exported for name. They are computed
+// once per name, so the flushes do not normalize the same names over and
+// over. The cache is emptied when it grows beyond nameCacheSize, e.g. as
+// names with ever new labels come and go.
+func (c *PrometheusConfig) promName(name string) *promName {
+	if n, ok := c.names[name]; ok {
+		return n
+	}
+	if len(c.names) >= nameCacheSize {
+		c.names = make(map[string]*promName)
+	}
+	namespace, subsystem, n := c.Namespace, c.Subsystem, name
+	for _, stage := range c.nameStages() {
+		namespace, subsystem, n = stage(namespace, subsystem, n)
+	}
+	n = c.shorten(namespace, subsystem, n)
+	cached := &promName{
+		namespace: namespace,
+		subsystem: subsystem,
+		name:      n,
+		fqName:    prometheus.BuildFQName(namespace, subsystem, n),
+	}
+	c.names[name] = cached
+	return cached
+}
+
+// nameStages returns the stages the names of exported metrics go through:
+// the stage of Rename and the one of StripPrefix, followed by the stages of
+// NamePipeline or, without a pipeline, the default normalization.
+func (c *PrometheusConfig) nameStages() []NameStage {
+	var stages []NameStage
+	if c.rename != nil {
+		stages = append(stages, c.rename)
+	}
+	if c.stripPrefix != nil {
+		stages = append(stages, c.stripPrefix)
+	}
+	if c.namePipeline != nil {
+		return append(stages, c.namePipeline...)
+	}
+	return append(stages, NormalizeStage(c.normalizeComponent, c.keyNormalizer))
+}
+
+// fqName returns the fully qualified name of the Prometheus metric exported
+// for name.
+func (c *PrometheusConfig) fqName(name string) string {
+	return c.promName(name).fqName
+}
+
+// metricOpts returns the options of the Prometheus metric exported for name.
+func (c *PrometheusConfig) metricOpts(name string, labels prometheus.Labels) prometheus.Opts {
+	namespace, subsystem, n := c.promNames(name)
+	return c.flatten(prometheus.Opts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        n,
+		Help:        c.help(name),
+		ConstLabels: labels,
+	})
+}
+
+// help returns the help of the Prometheus metric exported for name.
+func (c *PrometheusConfig) help(name string) string {
+	if c.helpText != nil {
+		if help := c.helpText(name); help != "" {
+			return help
+		}
+	}
+	return name
+}
+
+// opts returns the options of a Prometheus metric with a fixed name, like
+// the provider's own metrics.
+func (c *PrometheusConfig) opts(name, help string, labels prometheus.Labels) prometheus.Opts {
+	return c.flatten(prometheus.Opts{
+		Namespace:   c.promNamespace(),
+		Subsystem:   c.promSubsystem(),
+		Name:        name,
+		Help:        help,
+		ConstLabels: labels,
+	})
+}
+
+func (c *PrometheusConfig) flatten(opts prometheus.Opts) prometheus.Opts {
+	if c.flat {
+		opts.Name = prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name)
+		opts.Namespace, opts.Subsystem = "", ""
+	}
+	return opts
+}
+
+// nameHashLength is the length of the suffix replacing the tail of names
+// longer than MaxNameLength.
+const nameHashLength = 9
+
+// shorten replaces the tail of name by a hash if the fully qualified name
+// is longer than MaxNameLength.
+func (c *PrometheusConfig) shorten(namespace, subsystem, name string) string {
+	if c.maxNameLength == 0 {
+		return name
+	}
+	excess := len(prometheus.BuildFQName(namespace, subsystem, name)) - c.maxNameLength
+	if excess <= 0 {
+		return name
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	keep := len(name) - excess - nameHashLength
+	if keep < 0 {
+		keep = 0
+	}
+	return fmt.Sprintf("%s_%08x", name[:keep], h.Sum32())
+}
@@ -0,0 +1,207 @@
+package prometheusmetrics
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamePipeline(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), NamePipeline([]NameStage{
+		StripPrefixStage("app."),
+		RenameStage(map[string]string{"db.conns.active": "database.connections"}),
+		NormalizeStage(strings.ToUpper, DefaultKeyNormalizer),
+	}))
+	metricsRegistry.Register("app.db.conns.active", metrics.NewGauge())
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Equal(t, "TEST_SUBSYS_database_connections", families[0].GetName())
+}
+
+func TestSubsystemMapStage(t *testing.T) {
+	stage := SubsystemMapStage(map[string]string{"db": "database"})
+	namespace, subsystem, name := stage("test", "subsys", "db.queries")
+	assert.Equal(t, []string{"test", "database", "queries"}, []string{namespace, subsystem, name})
+	namespace, subsystem, name = stage("test", "subsys", "http.requests")
+	assert.Equal(t, []string{"test", "subsys", "http.requests"}, []string{namespace, subsystem, name})
+}
+
+func TestDefaultNamePipeline(t *testing.T) {
+	pClient, _ := NewPrometheusProvider(metrics.NewRegistry(), "test", "sub-sys", prometheus.NewRegistry())
+	namespace, subsystem, name := pClient.promNames("some.metric-name")
+	assert.Equal(t, []string{"test", "sub_sys", "some_metric_name"}, []string{namespace, subsystem, name})
+}
+
+func TestHelpText(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	help := map[string]string{"requests": "Number of requests served."}
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), HelpText(func(name string) string {
+		return help[name]
+	}))
+	metricsRegistry.Register("requests", metrics.NewCounter())
+	metricsRegistry.Register("undocumented", metrics.NewGauge())
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Equal(t, "Number of requests served.", families[0].GetHelp())
+	assert.Equal(t, "undocumented", families[1].GetHelp(), "metrics without help text should keep their name as help")
+}
+
+// prefixDescriptions describes every metric of a prefix the same way.
+type prefixDescriptions map[string]string
+
+func (d prefixDescriptions) Description(name string) string {
+	for prefix, description := range d {
+		if strings.HasPrefix(name, prefix) {
+			return description
+		}
+	}
+	return ""
+}
+
+func TestDescriptions(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		Descriptions(prefixDescriptions{"db.": "Database statistic."}))
+	metricsRegistry.Register("db.queries", metrics.NewCounter())
+	metricsRegistry.Register("undocumented", metrics.NewGauge())
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Equal(t, "Database statistic.", families[0].GetHelp())
+	assert.Equal(t, "undocumented", families[1].GetHelp(), "metrics without description should keep their name as help")
+
+	_, err = NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, Descriptions(nil))
+	assert.Error(t, err)
+}
+
+func TestEmptyNameComponents(t *testing.T) {
+	for _, tc := range []struct{ namespace, subsystem, name string }{
+		{"myapp", "", "myapp_counter"},
+		{"", "myapp", "myapp_counter"},
+		{"", "", "counter"},
+	} {
+		prometheusRegistry := prometheus.NewRegistry()
+		metricsRegistry := metrics.NewRegistry()
+		pClient, _ := NewPrometheusProvider(metricsRegistry, tc.namespace, tc.subsystem, prometheusRegistry, FlushRate(1*time.Second))
+		metricsRegistry.Register("counter", metrics.NewCounter())
+
+		families, err := pClient.FlushAndGather()
+		assert.NoError(t, err)
+		assert.Equal(t, tc.name, families[0].GetName())
+		assert.Contains(t, pClient.counters, tc.name, "the key should be derived like the name")
+
+		_, err = pClient.FlushAndGather()
+		assert.NoError(t, err, "the next flush should find the registered counter")
+		assert.Len(t, pClient.counters, 1)
+	}
+}
+
+func TestInvalidNames(t *testing.T) {
+	_, err := NewPrometheusProvider(metrics.NewRegistry(), "1st", "subsys", prometheus.NewRegistry())
+	assert.EqualError(t, err, "invalid namespace '1st'")
+	_, err = NewPrometheusProvider(metrics.NewRegistry(), "test", "sub/sys", prometheus.NewRegistry())
+	assert.EqualError(t, err, "invalid subsystem 'sub/sys'")
+
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var failed []string
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), OnError(func(name string, err error) {
+		failed = append(failed, name)
+	}))
+	metricsRegistry.Register("disk/used", metrics.NewGauge())
+	metricsRegistry.Register("disk.free", metrics.NewGauge())
+
+	families, err := pClient.FlushAndGather()
+	assert.Error(t, err)
+	assert.Equal(t, []string{"disk/used"}, failed, "invalid names should be reported")
+	assert.Len(t, families, 1, "metrics with invalid names should be skipped")
+	assert.Equal(t, "test_subsys_disk_free", families[0].GetName())
+}
+
+func TestStripPrefix(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "app", prometheusRegistry, FlushRate(1*time.Second), StripPrefix("app."))
+	metrics.NewPrefixedChildRegistry(metricsRegistry, "app.").Register("requests", metrics.NewGauge())
+	metricsRegistry.Register("other.requests", metrics.NewGauge())
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Equal(t, "test_app_other_requests", families[0].GetName(), "names without the prefix should be unchanged")
+	assert.Equal(t, "test_app_requests", families[1].GetName())
+}
+
+func TestStripPrefixBeforePipeline(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		StripPrefix("app."), Rename(map[string]string{"app.conns": "app.connections"}),
+		NamePipeline([]NameStage{NormalizeStage(DefaultKeyNormalizer, strings.ToUpper)}))
+	metricsRegistry.Register("app.conns", metrics.NewGauge())
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Equal(t, "test_subsys_CONNECTIONS", families[0].GetName(), "the prefix should be stripped after renaming and before the pipeline")
+}
+
+func TestNameCacheIsBounded(t *testing.T) {
+	pClient, _ := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry())
+	for i := 0; i <= nameCacheSize; i++ {
+		pClient.fqName(fmt.Sprintf("metric.%d", i))
+	}
+	assert.Len(t, pClient.names, 1, "the cache should be emptied once full")
+	assert.Equal(t, "test_subsys_metric_1", pClient.fqName("metric.1"))
+}
+
+func BenchmarkDefaultKeyNormalizer(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		prometheus.BuildFQName("test", "subsys", DefaultKeyNormalizer("http.requests-total count"))
+	}
+}
+
+func BenchmarkCachedName(b *testing.B) {
+	pClient, _ := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pClient.fqName("http.requests-total count")
+	}
+}
+
+func TestRename(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		Rename(map[string]string{"db.conns.active": "database.connections"}))
+	metricsRegistry.Register("db.conns.active", metrics.NewGauge())
+	metricsRegistry.Register("db.conns.idle", metrics.NewGauge())
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Equal(t, "test_subsys_database_connections", families[0].GetName(), "renamed names should be normalized")
+	assert.Equal(t, "test_subsys_db_conns_idle", families[1].GetName(), "unmapped names should pass through")
+}
+
+func TestRenameBeforePipeline(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		Rename(map[string]string{"conns": "db.connections"}),
+		NamePipeline([]NameStage{SubsystemMapStage(map[string]string{"db": "database"}), NormalizeStage(DefaultKeyNormalizer, DefaultKeyNormalizer)}))
+	metricsRegistry.Register("conns", metrics.NewGauge())
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Equal(t, "test_database_connections", families[0].GetName(), "renamed names should go through the pipeline")
+}
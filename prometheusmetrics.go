@@ -1,12 +1,24 @@
 package prometheusmetrics
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"os"
 	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/rcrowley/go-metrics"
 )
 
@@ -17,14 +29,137 @@ type Normalizer func(name string) string
 // Prometheus Exporter
 
 type PrometheusConfig struct {
+	mu       sync.Mutex    // serializes flushes and the exported state they update
+	stopCh   chan struct{} // closed by Stop to end the flush loop
+	resetCh  chan struct{} // signals the flush loop a new flush interval
+	stopOnce sync.Once
+
 	Namespace     string
 	registry      metrics.Registry // Registry to be exported
 	Subsystem     string
 	promRegistry  prometheus.Registerer //Prometheus registry
 	FlushInterval time.Duration         //interval to update prom metrics
 	gauges        map[string]prometheus.Gauge
+	changes       map[string]*change // last value exported per series key
 	converter     MetricConverter
 	keyNormalizer Normalizer
+
+	typeConverters []typeConverter // converters used instead of converter per type
+
+	componentNormalizer Normalizer           // normalizes namespace and subsystem
+	namespace           string               // normalized Namespace
+	subsystem           string               // normalized Subsystem
+	names               map[string]*promName // exported names per metric name
+	namePipeline        []NameStage
+	stripPrefix         NameStage // StripPrefixStage of StripPrefix, nil if unset
+	rename              NameStage // RenameStage of Rename, nil if unset
+	helpText            func(name string) string
+	flat                bool
+
+	isolated    bool
+	constLabels prometheus.Labels // labels attached to every exported metric
+
+	instanceFromHost bool
+	instance         string
+
+	histograms       map[string]*histogramCollector
+	histogramBuckets map[string][]float64 // per metric name buckets for native histograms
+	defaultBuckets   []float64            // buckets of native histograms without an entry
+
+	typeResolver    PromTypeResolver
+	kinds           map[string]PromType     // type each metric is currently exported as
+	pendingKinds    map[string]*pendingKind // type changes waiting to become stable
+	kindStableAfter int
+
+	meterCounters bool
+	created       map[string]time.Time // when a counter series was started
+	meterSeries   []string             // suffixes of the series exported per meter
+	timerCounts   bool                 // export timer counts as counters
+
+	countersAsGauges bool
+
+	counters     map[string]prometheus.Counter
+	counterTotal map[string]float64 // value the prometheus counter was advanced to
+	untyped      map[string]*untypedCollector
+
+	registryName    string           // name of registry when exported next to others
+	extraRegistries []sourceRegistry // further registries exported by the provider
+	sourceLabel     string           // label identifying the registry of a metric
+	typeLabel       string           // label holding the go-metrics type, "" if none
+
+	gaugeVecs    map[string]*prometheus.GaugeVec
+	vecSeries    map[string]vecSeries        // series of gauge vecs per metric key
+	enumMappings map[string]map[int64]string // state names per gauge value
+
+	percentiles []float64 // percentiles exported for histograms
+	variance    bool
+	emptyAsNaN  bool
+	sinceUpdate bool
+	timerFamily bool
+
+	histogramStats     bool
+	histogramQuantiles []float64 // quantiles exported by histogramStats
+
+	timerStats     bool
+	timerQuantiles []float64     // quantiles exported by timerStats
+	timerUnit      time.Duration // unit of the timer statistics
+
+	tenantSegment int // index of the name segment holding the tenant, -1 if unused
+	labelConflict LabelConflict
+	typeSuffixes  bool
+	filter        func(name string) bool
+	skipFuncs     bool    // skip functional gauges
+	sampleRate    float64 // fraction of metric names exported
+	maxLabels     int     // most labels of a metric, 0 if unlimited
+	foldLabels    bool    // keep extracted labels exceeding maxLabels in the name
+	maxSeries     int     // most series of an exported name, 0 if unlimited
+	labelParser   func(name string) (string, prometheus.Labels)
+
+	markStale       bool
+	removeMissing   bool // remove series of metrics missing from a flush
+	staleMultiplier float64
+	staleAfter      time.Duration
+	seen            map[string]time.Time // when each metric was last seen in a flush
+	series          map[string]int       // number of seen series of each exported name
+
+	exporting string                         // key of the metric being exported
+	derived   map[string]map[string]PromType // collectors exported per metric key under other keys
+
+	recoverPanics bool
+
+	maxNameLength int
+	flushTimeout  time.Duration
+	flushInterval func() time.Duration
+	ticker        func(d time.Duration) <-chan time.Time
+	flushOnStart  bool
+	startupDelay  time.Duration
+	jitter        time.Duration
+	jitterRand    *rand.Rand // only used by the flush loop
+	logf          func(format string, args ...interface{})
+	nonFinite     bool // export NaN and infinite converted values
+	transform     func(name string, v float64) float64
+	onError       func(name string, err error)
+	started       time.Time
+	rateWarmup    time.Duration
+	unitLimits    map[string]float64
+
+	selfMetrics bool
+	self        *selfMetrics
+	lastFlushOK int32 // 1 unless the last flush failed, accessed atomically
+	running     int32 // 1 while the flush loop runs, accessed atomically
+
+	healthEndpoint bool
+	buildInfo      prometheus.Labels
+	buildInfoHelp  string
+	buildInfoUnit  string // suffix of the build info name, "" if none
+	gaugeFuncs     map[string]func() float64
+	static         []prometheus.Collector // registered by NewPrometheusProvider
+
+	adopted map[prometheus.Collector]bool // registered by others and taken over
+
+	summaries         map[string]*summaryCollector
+	timerSummaries    bool
+	summaryObjectives map[float64]float64
 }
 
 type optSetter func(c *PrometheusConfig) error
@@ -36,6 +171,37 @@ func Converter(converter MetricConverter) optSetter {
 	}
 }
 
+// ConverterFor converts the metrics of type t with converter instead of the
+// converter of the provider. t is either a concrete type or an interface
+// type like reflect.TypeOf((*metrics.Timer)(nil)).Elem(), matching every
+// metric implementing it. A metric matching several types is converted by the
+// converter given first.
+func ConverterFor(t reflect.Type, converter MetricConverter) optSetter {
+	return func(c *PrometheusConfig) error {
+		if t == nil {
+			return errors.New("converter type must not be nil")
+		}
+		c.typeConverters = append(c.typeConverters, typeConverter{t: t, converter: converter})
+		return nil
+	}
+}
+
+type typeConverter struct {
+	t         reflect.Type
+	converter MetricConverter
+}
+
+// convert converts the metric with the converter for its type.
+func (c *PrometheusConfig) convert(name string, i interface{}) (float64, error) {
+	t := reflect.TypeOf(i)
+	for _, tc := range c.typeConverters {
+		if t == tc.t || (t != nil && tc.t.Kind() == reflect.Interface && t.Implements(tc.t)) {
+			return tc.converter(name, i)
+		}
+	}
+	return c.converter(name, i)
+}
+
 func KeyNormalizer(normalizer Normalizer) optSetter {
 	return func(c *PrometheusConfig) error {
 		c.keyNormalizer = normalizer
@@ -43,99 +209,2218 @@ func KeyNormalizer(normalizer Normalizer) optSetter {
 	}
 }
 
-func FlushRate(duration time.Duration) optSetter {
+// ComponentNormalizer sets the normalizer applied to the namespace and
+// subsystem. By default they are kept as they are if valid and normalized
+// like metric names otherwise.
+func ComponentNormalizer(normalizer Normalizer) optSetter {
 	return func(c *PrometheusConfig) error {
-		c.FlushInterval = duration
+		c.componentNormalizer = normalizer
 		return nil
 	}
 }
 
-func DefaultMetricConverter(name string, i interface{}) (float64, error) {
-	switch metric := i.(type) {
-	case metrics.Counter:
-		return float64(metric.Count()), nil
-	case metrics.Gauge:
-		return float64(metric.Value()), nil
-	case metrics.GaugeFloat64:
-		return float64(metric.Value()), nil
-	case metrics.Histogram:
-		samples := metric.Snapshot().Sample().Values()
-		if len(samples) > 0 {
-			lastSample := samples[len(samples)-1]
-			return float64(lastSample), nil
+// NamePipeline replaces the normalization of metric names, namespace and
+// subsystem with the given stages, applied in order.
+func NamePipeline(stages []NameStage) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.namePipeline = stages
+		return nil
+	}
+}
+
+// StripPrefix removes prefix from metric names starting with it before they
+// are normalized, e.g. the prefix of a metrics.PrefixedRegistry. Other names
+// are exported unchanged. The prefix is removed by a StripPrefixStage in
+// front of the stages of NamePipeline or the default normalization.
+func StripPrefix(prefix string) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.stripPrefix = StripPrefixStage(prefix)
+		return nil
+	}
+}
+
+// Rename exports the metrics found in names under their mapped name, which is
+// normalized like any other name. Other names are exported unchanged. The
+// names are mapped by a RenameStage in front of the stages of NamePipeline or
+// the default normalization.
+func Rename(names map[string]string) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.rename = RenameStage(names)
+		return nil
+	}
+}
+
+// HelpText sets the help of exported metrics to the text fn returns for
+// their go-metrics name. Metrics fn returns no text for keep their name as
+// help.
+func HelpText(fn func(name string) string) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.helpText = fn
+		return nil
+	}
+}
+
+// DescriptionResolver describes go-metrics metrics, which have no
+// description of their own.
+type DescriptionResolver interface {
+	// Description returns the help text of the metric name, or "" if it
+	// has none.
+	Description(name string) string
+}
+
+// Descriptions sets the help of exported metrics to the description r
+// resolves for their go-metrics name when their collector is created, like
+// HelpText.
+func Descriptions(r DescriptionResolver) optSetter {
+	return func(c *PrometheusConfig) error {
+		if r == nil {
+			return errors.New("description resolver must not be nil")
 		}
-	case metrics.Meter:
-		lastSample := metric.Snapshot().Rate1()
-		return float64(lastSample), nil
-	case metrics.Timer:
-		lastSample := metric.Snapshot().Rate1()
-		return float64(lastSample), nil
+		c.helpText = r.Description
+		return nil
 	}
+}
 
-	return 0.0, fmt.Errorf("metric '%s' has unknown type: %s", name, reflect.TypeOf(i))
+// Flat exports metrics with their namespace and subsystem joined into the
+// metric name instead of setting them as separate components.
+func Flat(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.flat = enabled
+		return nil
+	}
 }
 
-func DefaultKeyNormalizer(key string) string {
-	key = strings.Replace(key, " ", "_", -1)
-	key = strings.Replace(key, ".", "_", -1)
-	key = strings.Replace(key, "-", "_", -1)
-	key = strings.Replace(key, "=", "_", -1)
+// HistogramBuckets exports metrics.Histogram as native Prometheus histograms.
+// Buckets are looked up by metric name, names without an entry use
+// prometheus.DefBuckets.
+func HistogramBuckets(buckets map[string][]float64) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.histogramBuckets = buckets
+		return nil
+	}
+}
 
-	return key
+// DefaultHistogramBuckets exports metrics.Histogram as native Prometheus
+// histograms with the given buckets, except for the names HistogramBuckets
+// has an entry for. The bucket counts are computed from the sample of the
+// histogram on each flush, so histogram_quantile() can aggregate them across
+// instances.
+func DefaultHistogramBuckets(buckets []float64) optSetter {
+	return func(c *PrometheusConfig) error {
+		if len(buckets) == 0 {
+			return errors.New("default histogram buckets must not be empty")
+		}
+		c.defaultBuckets = buckets
+		return nil
+	}
 }
 
-func LowerCaseKeyNormalizer(key string) string { return strings.ToLower(DefaultKeyNormalizer(key)) }
+// Isolated makes the provider register its metrics in a private registry
+// instead of the one it was given, so a name collision can never panic a
+// shared registry. The metrics are then only available through Gatherer().
+func Isolated(isolated bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.isolated = isolated
+		return nil
+	}
+}
 
-// NewPrometheusProvider returns a Provider that produces Prometheus metrics.
-// Namespace and Subsystem are applied to all produced metrics.
-func NewPrometheusProvider(r metrics.Registry, namespace string, subsystem string, promRegistry prometheus.Registerer, setters ...optSetter) (*PrometheusConfig, error) {
-	conf := &PrometheusConfig{
-		Namespace:     namespace,
-		Subsystem:     subsystem,
-		registry:      r,
-		promRegistry:  promRegistry,
-		FlushInterval: 15 * time.Second,
-		gauges:        make(map[string]prometheus.Gauge),
-		converter:     DefaultMetricConverter,
-		keyNormalizer: DefaultKeyNormalizer,
+// InstanceLabel adds an "instance" label holding the hostname to every
+// exported metric.
+func InstanceLabel(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.instanceFromHost = enabled
+		return nil
 	}
+}
 
-	for _, s := range setters {
-		if err := s(conf); err != nil {
-			return nil, err
+// InstanceLabelValue adds an "instance" label with the given value to every
+// exported metric.
+func InstanceLabelValue(instance string) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.instance = instance
+		return nil
+	}
+}
+
+// TimerSummaries exports metrics.Timer as Prometheus summaries.
+func TimerSummaries(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.timerSummaries = enabled
+		return nil
+	}
+}
+
+// SummaryObjectives sets the quantile objectives of exported summaries,
+// given as quantile to tolerated error like prometheus.SummaryOpts.
+func SummaryObjectives(objectives map[float64]float64) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.summaryObjectives = objectives
+		return nil
+	}
+}
+
+// TypeChangeThreshold sets how many consecutive flushes a metric has to keep
+// a new type before it is re-registered under that type. Until then the
+// previously exported series is left untouched. Defaults to 1.
+func TypeChangeThreshold(flushes int) optSetter {
+	return func(c *PrometheusConfig) error {
+		if flushes < 1 {
+			return fmt.Errorf("type change threshold must be at least 1, got %d", flushes)
 		}
+		c.kindStableAfter = flushes
+		return nil
 	}
+}
 
-	return conf, nil
+// SelfMetrics makes the provider export metrics about itself next to the
+// ones from the go-metrics registry.
+func SelfMetrics(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.selfMetrics = enabled
+		return nil
+	}
 }
 
-func (c *PrometheusConfig) gaugeFromNameAndValue(name string, val float64) {
-	key := fmt.Sprintf("%s_%s_%s", c.Namespace, c.Subsystem, name)
-	g, ok := c.gauges[key]
-	if !ok {
-		g = prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: c.keyNormalizer(c.Namespace),
-			Subsystem: c.keyNormalizer(c.Subsystem),
-			Name:      c.keyNormalizer(name),
-			Help:      name,
-		})
-		c.promRegistry.MustRegister(g)
-		c.gauges[key] = g
+// meterSeries are the values of a meter exported by MeterSeries, by suffix.
+var meterSeries = map[string]func(metrics.Meter) float64{
+	"rate1":  metrics.Meter.Rate1,
+	"rate5":  metrics.Meter.Rate5,
+	"rate15": metrics.Meter.Rate15,
+	"mean":   metrics.Meter.RateMean,
+}
+
+// MeterSeries exports meters as a series per given suffix instead of a
+// single gauge of their one-minute rate, e.g. requests_rate5 for "rate5".
+// The suffixes "rate1", "rate5", "rate15" and "mean" export the rates as
+// gauges, "count" exports the total count as a counter.
+func MeterSeries(suffixes ...string) optSetter {
+	return func(c *PrometheusConfig) error {
+		for _, suffix := range suffixes {
+			if _, ok := meterSeries[suffix]; !ok && suffix != "count" {
+				return fmt.Errorf("unknown meter series %q", suffix)
+			}
+		}
+		c.meterSeries = suffixes
+		return nil
 	}
-	g.Set(val)
 }
-func (c *PrometheusConfig) UpdatePrometheusMetrics() {
-	for _ = range time.Tick(c.FlushInterval) {
-		c.UpdatePrometheusMetricsOnce()
+
+// TreatCountersAsGauges exports metrics.Counter as gauges, as done before
+// counters were exported as native Prometheus counters.
+func TreatCountersAsGauges(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.countersAsGauges = enabled
+		return nil
 	}
 }
 
-func (c *PrometheusConfig) UpdatePrometheusMetricsOnce() error {
-	c.registry.Each(func(name string, i interface{}) {
-		value, err := c.converter(name, i)
-		if err == nil {
-			c.gaugeFromNameAndValue(name, value)
+// TimerCounts exports the total count of timers exported as gauges as a
+// <name>_count counter next to their other series, so Prometheus can
+// compute rates across instances itself. Meters export their count along
+// their rates with MeterSeries, e.g. MeterSeries("rate1", "count").
+func TimerCounts(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.timerCounts = enabled
+		return nil
+	}
+}
+
+// MeterCounters exports the total count of meters as a <name>_total
+// counter instead of their rates, which are not exported at all. The
+// client_golang versions this package supports cannot attach OpenMetrics
+// created timestamps to a counter, so the Unix time the provider started the
+// counter at is exported as a separate <name>_start_time_seconds gauge
+// instead, following process_start_time_seconds. It does not use the
+// _created suffix OpenMetrics reserves for the counter's own created sample.
+func MeterCounters(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.meterCounters = enabled
+		return nil
+	}
+}
+
+// TypeResolver decides per metric which type of Prometheus metric it is
+// exported as. It is consulted on every flush, before the value of the metric
+// is converted. Without a resolver counters are exported as counters unless
+// TreatCountersAsGauges is enabled, histograms and timers follow the
+// HistogramBuckets and TimerSummaries options, and everything else is
+// exported as a gauge. A resolver always returning GaugeType exports every
+// metric as a gauge.
+func TypeResolver(resolver PromTypeResolver) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.typeResolver = resolver
+		return nil
+	}
+}
+
+// MaxNameLength limits the length of exported metric names. Longer names
+// keep a readable prefix and have their tail replaced by a hash, so they stay
+// unique and are shortened the same way on every flush.
+func MaxNameLength(length int) optSetter {
+	return func(c *PrometheusConfig) error {
+		if length <= nameHashLength {
+			return fmt.Errorf("max name length must be greater than %d, got %d", nameHashLength, length)
 		}
-	})
-	return nil
+		c.maxNameLength = length
+		return nil
+	}
+}
+
+// FlushTimeout aborts a flush that takes longer than timeout. The metrics
+// processed up to then stay exported, the rest is picked up by the next
+// flush.
+func FlushTimeout(timeout time.Duration) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.flushTimeout = timeout
+		return nil
+	}
+}
+
+// SourceRegistry exports the metrics of another go-metrics registry next to
+// the ones of the registry the provider was created with. A metric with the
+// same exported name and labels as one of an earlier registry fails to
+// export, SourceRegistryLabel keeps them apart.
+func SourceRegistry(name string, r metrics.Registry) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.extraRegistries = append(c.extraRegistries, sourceRegistry{name: name, registry: r})
+		return nil
+	}
+}
+
+// RegistryName sets the name identifying the registry the provider was
+// created with among the ones added by SourceRegistry. Defaults to "default".
+func RegistryName(name string) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.registryName = name
+		return nil
+	}
+}
+
+// SourceRegistryLabel adds a label with the given name to every exported
+// metric, holding the name of the go-metrics registry it came from.
+func SourceRegistryLabel(label string) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.sourceLabel = label
+		return nil
+	}
+}
+
+// TypeLabel adds a "metric_type" label to every exported metric, holding its
+// go-metrics type, e.g. "timer". TypeLabelName changes the name of the label.
+func TypeLabel(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		if !enabled {
+			c.typeLabel = ""
+		} else if c.typeLabel == "" {
+			c.typeLabel = "metric_type"
+		}
+		return nil
+	}
+}
+
+// TypeLabelName adds a label with the given name to every exported metric,
+// holding its go-metrics type.
+func TypeLabelName(label string) optSetter {
+	return func(c *PrometheusConfig) error {
+		if !validLabelName(label) {
+			return fmt.Errorf("invalid type label name %q", label)
+		}
+		c.typeLabel = label
+		return nil
+	}
+}
+
+// metricTypeName returns the name of the go-metrics type of a metric for
+// TypeLabel.
+func metricTypeName(i interface{}) string {
+	switch i.(type) {
+	case metrics.Timer:
+		return "timer"
+	case metrics.Histogram:
+		return "histogram"
+	case metrics.Meter:
+		return "meter"
+	case metrics.EWMA:
+		return "ewma"
+	case metrics.GaugeFloat64:
+		return "gauge_float64"
+	case metrics.Gauge:
+		return "gauge"
+	case metrics.Counter:
+		return "counter"
+	case metrics.Healthcheck:
+		return "healthcheck"
+	}
+	return "unknown"
+}
+
+// EnumMapping exports the listed gauges as enums. The values of such a
+// gauge are mapped to state names and exported with a "state" label, the
+// series of the current state is 1 and the ones of all other states 0.
+func EnumMapping(mappings map[string]map[int64]string) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.enumMappings = mappings
+		return nil
+	}
+}
+
+// TenantSegment moves the dot separated segment at index of every metric
+// name into a "tenant" label, e.g. with index 1 "svc.acme.requests" is
+// exported as svc_requests{tenant="acme"}. The last segment is the name of
+// the metric itself, so names without a segment after index are exported
+// unchanged.
+func TenantSegment(index int) optSetter {
+	return func(c *PrometheusConfig) error {
+		if index < 0 {
+			return fmt.Errorf("tenant segment index must not be negative, got %d", index)
+		}
+		c.tenantSegment = index
+		return nil
+	}
+}
+
+// LabelParser exports metrics with the base name and labels parse returns for
+// their name, e.g. CommaLabels. Names parsed without labels are exported
+// unchanged. Gauges of the same base name share a GaugeVec with the parsed
+// labels as variable labels, whose stale label values are deleted by
+// RemoveStaleMetrics and MarkStale.
+func LabelParser(parse func(name string) (base string, labels prometheus.Labels)) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.labelParser = parse
+		return nil
+	}
+}
+
+// CommaLabels parses labels appended to metric names after commas, e.g.
+// "http_requests,method=GET,code=200" is exported as
+// http_requests{code="200",method="GET"}. Names with a segment that is not
+// a key=value pair are returned without labels.
+func CommaLabels(name string) (string, prometheus.Labels) {
+	segments := strings.Split(name, ",")
+	if len(segments) == 1 {
+		return name, nil
+	}
+	labels := prometheus.Labels{}
+	for _, segment := range segments[1:] {
+		kv := strings.SplitN(segment, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return name, nil
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return segments[0], labels
+}
+
+// LabelConflict is the policy applied when a label extracted from a metric
+// name is also one of the const labels of the metric.
+type LabelConflict int
+
+const (
+	// ConstWins keeps the value of the const label.
+	ConstWins LabelConflict = iota
+	// ExtractedWins keeps the value extracted from the name.
+	ExtractedWins
+	// ConflictError fails the export of the metric.
+	ConflictError
+)
+
+// LabelConflictPolicy sets how labels extracted from metric names and const
+// labels with the same name are resolved. The default is ConstWins.
+func LabelConflictPolicy(policy LabelConflict) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.labelConflict = policy
+		return nil
+	}
+}
+
+// TypeFromNameSuffix exports metrics whose name ends with .counter, .gauge
+// or .histogram as that type, overriding any other type resolution, with the
+// suffix removed from the exported name.
+func TypeFromNameSuffix(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.typeSuffixes = enabled
+		return nil
+	}
+}
+
+// MetricFilter only exports the metrics of the registries for whose
+// go-metrics name, before any normalization, fn returns true. The series of
+// metrics no longer exported are removed by MarkStale and RemoveStaleMetrics.
+func MetricFilter(fn func(name string) bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.filter = fn
+		return nil
+	}
+}
+
+// SkipFunctionalGauges does not export the functional gauges of the
+// registries. Their functions are called on every flush, which can be
+// expensive.
+func SkipFunctionalGauges(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.skipFuncs = enabled
+		return nil
+	}
+}
+
+// RegexpFilter returns a MetricFilter matching the names matched by include
+// but not by exclude. A nil include matches every name, a nil exclude none.
+func RegexpFilter(include, exclude *regexp.Regexp) func(name string) bool {
+	return func(name string) bool {
+		return (include == nil || include.MatchString(name)) && (exclude == nil || !exclude.MatchString(name))
+	}
+}
+
+// SampleRate only exports the given fraction of the metrics of the
+// registries. Metrics are selected by a hash of their name, so the same
+// metrics are exported by every flush and across restarts.
+func SampleRate(rate float64) optSetter {
+	return func(c *PrometheusConfig) error {
+		if rate <= 0 || rate > 1 {
+			return fmt.Errorf("sample rate must be greater than 0 and at most 1, got %g", rate)
+		}
+		c.sampleRate = rate
+		return nil
+	}
+}
+
+// MaxLabels limits the number of labels of a metric including those
+// extracted from its name, e.g. by TenantSegment. Metrics with more labels
+// are rejected with a logged warning, unless FoldExcessLabels is enabled.
+func MaxLabels(n int) optSetter {
+	return func(c *PrometheusConfig) error {
+		if n < 0 {
+			return fmt.Errorf("max labels must not be negative, got %d", n)
+		}
+		c.maxLabels = n
+		return nil
+	}
+}
+
+// MaxSeriesPerMetric limits the number of label combinations exported under
+// the same name, e.g. of labels parsed by LabelParser. Once the limit is
+// reached, metrics adding another combination fail with
+// ErrCardinalityExceeded while the existing series keep being updated. A
+// series removed as stale frees its slot.
+func MaxSeriesPerMetric(n int) optSetter {
+	return func(c *PrometheusConfig) error {
+		if n < 0 {
+			return fmt.Errorf("max series must not be negative, got %d", n)
+		}
+		c.maxSeries = n
+		return nil
+	}
+}
+
+// FoldExcessLabels exports metrics that would have more labels than
+// MaxLabels with the segments of their name left in place instead of
+// extracting them as labels.
+func FoldExcessLabels(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.foldLabels = enabled
+		return nil
+	}
+}
+
+// Percentiles exports histograms as their percentiles, each as a gauge
+// labeled with its quantile, e.g. quantile="0.999".
+func Percentiles(percentiles ...float64) optSetter {
+	return func(c *PrometheusConfig) error {
+		for _, p := range percentiles {
+			if p < 0 || p > 1 {
+				return fmt.Errorf("percentile must be between 0 and 1, got %g", p)
+			}
+		}
+		c.percentiles = percentiles
+		return nil
+	}
+}
+
+// EmptyPercentilesAsNaN exports the percentiles of histograms and timers
+// without any samples as NaN instead of 0, so they show up as gaps.
+func EmptyPercentilesAsNaN(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.emptyAsNaN = enabled
+		return nil
+	}
+}
+
+// HistogramStats exports each histogram as gauges of its count, min, max,
+// mean, standard deviation and quantiles, e.g. size_count and size_p99.
+func HistogramStats(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.histogramStats = enabled
+		return nil
+	}
+}
+
+// HistogramQuantiles sets the quantiles exported by HistogramStats. The
+// default is 0.5, 0.9 and 0.99.
+func HistogramQuantiles(quantiles []float64) optSetter {
+	return func(c *PrometheusConfig) error {
+		for _, q := range quantiles {
+			if q < 0 || q > 1 {
+				return fmt.Errorf("quantile must be between 0 and 1, got %g", q)
+			}
+		}
+		c.histogramQuantiles = quantiles
+		return nil
+	}
+}
+
+// TimerStats exports each timer as gauges of its min, max, mean, standard
+// deviation, quantiles and rates, e.g. latency_max, latency_p99 and
+// latency_rate1.
+func TimerStats(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.timerStats = enabled
+		return nil
+	}
+}
+
+// TimerQuantiles sets the quantiles exported by TimerStats. The default is
+// 0.5, 0.75, 0.95, 0.99 and 0.999.
+func TimerQuantiles(quantiles []float64) optSetter {
+	return func(c *PrometheusConfig) error {
+		for _, q := range quantiles {
+			if q < 0 || q > 1 {
+				return fmt.Errorf("quantile must be between 0 and 1, got %g", q)
+			}
+		}
+		c.timerQuantiles = quantiles
+		return nil
+	}
+}
+
+// TimerUnit sets the unit of the durations exported by TimerStats, e.g.
+// time.Second to export seconds. The default is nanoseconds, the unit
+// go-metrics records durations in.
+func TimerUnit(unit time.Duration) optSetter {
+	return func(c *PrometheusConfig) error {
+		if unit <= 0 {
+			return fmt.Errorf("timer unit must be positive, got %s", unit)
+		}
+		c.timerUnit = unit
+		return nil
+	}
+}
+
+// TimerFamilies exports each timer as a single gauge family, with a series
+// labeled kind="rate" for its one-minute rate and a series per percentile
+// labeled kind="latency_seconds" and its quantile.
+func TimerFamilies(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.timerFamily = enabled
+		return nil
+	}
+}
+
+// SecondsSinceUpdate additionally exports the seconds since the value of
+// each gauge and counter last changed as <name>_seconds_since_update.
+func SecondsSinceUpdate(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.sinceUpdate = enabled
+		return nil
+	}
+}
+
+// HistogramVariance additionally exports the variance of histograms exported
+// as percentiles as <name>_variance.
+func HistogramVariance(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.variance = enabled
+		return nil
+	}
+}
+
+// HealthEndpoint makes Handler serve /healthz, reporting whether the last
+// flush succeeded. The provider is healthy until its first flush, so probes
+// do not fail while waiting for the first flush interval.
+func HealthEndpoint(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.healthEndpoint = enabled
+		return nil
+	}
+}
+
+// ConstLabels adds the given labels to every exported metric, e.g.
+// region="us-east".
+func ConstLabels(labels prometheus.Labels) optSetter {
+	return func(c *PrometheusConfig) error {
+		for name, value := range labels {
+			if !validLabelName(name) {
+				return fmt.Errorf("invalid const label name %q", name)
+			}
+			c.constLabels[name] = value
+		}
+		return nil
+	}
+}
+
+// BuildInfo exports a build_info gauge with value 1 carrying the given
+// labels. The listed required labels, "version" if none are given, must be
+// present and non-empty.
+func BuildInfo(labels prometheus.Labels, required ...string) optSetter {
+	return func(c *PrometheusConfig) error {
+		if len(required) == 0 {
+			required = []string{"version"}
+		}
+		for _, name := range required {
+			if labels[name] == "" {
+				return fmt.Errorf("build info label %q must not be empty", name)
+			}
+		}
+		for name := range labels {
+			if !validLabelName(name) {
+				return fmt.Errorf("invalid build info label name %q", name)
+			}
+		}
+		c.buildInfo = labels
+		return nil
+	}
+}
+
+// BuildInfoHelp sets the help of the gauge exported by BuildInfo.
+func BuildInfoHelp(help string) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.buildInfoHelp = help
+		return nil
+	}
+}
+
+// BuildInfoUnit appends the unit to the name of the gauge exported by
+// BuildInfo, e.g. build_info_timestamp_seconds for "timestamp_seconds".
+func BuildInfoUnit(unit string) optSetter {
+	return func(c *PrometheusConfig) error {
+		if unit != "" && !metricNameRE.MatchString("build_info_"+unit) {
+			return fmt.Errorf("invalid build info unit %q", unit)
+		}
+		c.buildInfoUnit = unit
+		return nil
+	}
+}
+
+// GaugeFuncs exports gauges whose value is computed by the given functions
+// whenever Prometheus collects them. They are independent of the go-metrics
+// registry and not touched by flushes.
+func GaugeFuncs(funcs map[string]func() float64) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.gaugeFuncs = funcs
+		return nil
+	}
+}
+
+// MarkStale removes the Prometheus series of metrics that were not seen in
+// any flush for longer than the stale threshold.
+func MarkStale(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.markStale = enabled
+		return nil
+	}
+}
+
+// RemoveStaleMetrics removes the Prometheus series of metrics right after the
+// first flush they are no longer in the registry, e.g. after
+// registry.Unregister, instead of waiting for the stale threshold of
+// MarkStale.
+func RemoveStaleMetrics(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.removeMissing = enabled
+		return nil
+	}
+}
+
+// StaleMultiplier derives the stale threshold from the flush interval,
+// defaults to 2 times the flush interval.
+func StaleMultiplier(multiplier float64) optSetter {
+	return func(c *PrometheusConfig) error {
+		if multiplier < 1 {
+			return fmt.Errorf("stale multiplier must be at least 1, got %g", multiplier)
+		}
+		c.staleMultiplier = multiplier
+		return nil
+	}
+}
+
+// StaleAfter sets a fixed stale threshold instead of one derived from the
+// flush interval.
+func StaleAfter(threshold time.Duration) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.staleAfter = threshold
+		return nil
+	}
+}
+
+// RecoverPanics recovers from panics while exporting a metric, e.g. in a
+// converter, a functional gauge or a LabelParser. The metric is skipped and
+// counted as failed, while every other metric of the flush is still
+// exported.
+func RecoverPanics(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.recoverPanics = enabled
+		return nil
+	}
+}
+
+func FlushRate(duration time.Duration) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.FlushInterval = duration
+		return nil
+	}
+}
+
+// Logger sets the function warnings of the provider are logged with, e.g.
+// log.Printf or the Printf method of another logger. Metrics failing to
+// export, like conversion errors and registration conflicts, and the removal
+// of stale metrics are logged. Warnings are discarded by default.
+func Logger(logf func(format string, args ...interface{})) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.logf = logf
+		return nil
+	}
+}
+
+// PrintfLogger is a logger warnings of the provider can be logged with, e.g.
+// a *log.Logger.
+type PrintfLogger interface {
+	Printf(format string, args ...interface{})
+}
+
+// WithLogger logs the warnings of the provider with l, like Logger with its
+// Printf method.
+func WithLogger(l PrintfLogger) optSetter {
+	return func(c *PrometheusConfig) error {
+		if l == nil {
+			return errors.New("logger must not be nil")
+		}
+		c.logf = l.Printf
+		return nil
+	}
+}
+
+// PropagateNonFinite exports NaN and infinite values returned by the
+// converter. By default such a value is not exported, the series keeps its
+// last value and the export fails with ErrNonFiniteValue.
+func PropagateNonFinite(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.nonFinite = enabled
+		return nil
+	}
+}
+
+// ValueTransform sets gauges to the value fn returns for the converted value
+// of their metric, e.g. to scale milliseconds to seconds per metric name.
+func ValueTransform(fn func(name string, v float64) float64) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.transform = fn
+		return nil
+	}
+}
+
+// OnError calls fn with the name of every metric that fails to export, e.g.
+// because it cannot be converted or registered, and the reason. fn is called
+// synchronously during the flush, in the order the metrics are exported. A
+// flush of the flush loop aborted by FlushTimeout is passed with an empty
+// name.
+func OnError(fn func(name string, err error)) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.onError = fn
+		return nil
+	}
+}
+
+// UnitCheck logs a warning for every exported value larger than the limit of
+// the suffix its metric name ends with, e.g. {"_seconds": 1e6} to catch
+// durations exported in nanoseconds.
+func UnitCheck(limits map[string]float64) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.unitLimits = limits
+		return nil
+	}
+}
+
+// RateWarmup skips exporting the rates of meters and timers until the
+// provider has been running for d, while their moving averages warm up.
+// Counts, like those exported by MeterCounters, are exported right away.
+func RateWarmup(d time.Duration) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.rateWarmup = d
+		return nil
+	}
+}
+
+// FlushIntervalFunc makes UpdatePrometheusMetrics wait for the interval
+// returned by fn before each flush, instead of the static FlushInterval.
+func FlushIntervalFunc(fn func() time.Duration) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.flushInterval = fn
+		return nil
+	}
+}
+
+// Ticker makes UpdatePrometheusMetrics and Run wait for a value on the
+// channel returned by fn for each flush interval d, instead of a timer. Tests
+// use it to drive the flushes without sleeping.
+func Ticker(fn func(d time.Duration) <-chan time.Time) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.ticker = fn
+		return nil
+	}
+}
+
+// FlushOnStart makes UpdatePrometheusMetrics and Run flush the registry once
+// when they start, so the metrics do not wait a full flush interval to be
+// exported.
+func FlushOnStart(enabled bool) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.flushOnStart = enabled
+		return nil
+	}
+}
+
+// StartupDelay makes UpdatePrometheusMetrics and Run wait delay instead of a
+// flush interval before their first flush.
+func StartupDelay(delay time.Duration) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.startupDelay = delay
+		return nil
+	}
+}
+
+// FlushJitter adds a random duration up to jitter to every wait of the flush
+// loop, so providers started at the same time do not flush in lockstep.
+func FlushJitter(jitter time.Duration) optSetter {
+	return func(c *PrometheusConfig) error {
+		if jitter < 0 {
+			return fmt.Errorf("flush jitter must not be negative, got %s", jitter)
+		}
+		c.jitter = jitter
+		c.jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+		return nil
+	}
+}
+
+// PrometheusValuer is implemented by custom metric types to be exported by
+// DefaultMetricConverter with the value they return.
+type PrometheusValuer interface {
+	PrometheusValue() (float64, error)
+}
+
+// DefaultMetricConverter converts the go-metrics types to a single value.
+// Custom types implementing PrometheusValuer are exported with the value it
+// returns. Custom types implementing several of the go-metrics interfaces are
+// matched against the most specific one first, in the order Timer,
+// Histogram, Meter, EWMA, GaugeFloat64, Gauge, Counter. Like every series
+// exported from timers, histograms and meters, the value is read from a
+// single snapshot of the metric. Types of forks of go-metrics, like
+// ResettingTimer, are not known to it and are exported with ConverterFor.
+func DefaultMetricConverter(name string, i interface{}) (float64, error) {
+	switch metric := i.(type) {
+	case PrometheusValuer:
+		return metric.PrometheusValue()
+	case metrics.Timer:
+		snapshot := metric.Snapshot()
+		return snapshot.Rate1(), nil
+	case metrics.Histogram:
+		snapshot := metric.Snapshot()
+		samples := snapshot.Sample().Values()
+		if len(samples) > 0 {
+			lastSample := samples[len(samples)-1]
+			return float64(lastSample), nil
+		}
+	case metrics.Meter:
+		snapshot := metric.Snapshot()
+		return snapshot.Rate1(), nil
+	case metrics.EWMA:
+		return metric.Rate(), nil
+	case *metrics.FunctionalGaugeFloat64:
+		// calls the function of the gauge, see SkipFunctionalGauges
+		return metric.Value(), nil
+	case *metrics.FunctionalGauge:
+		return float64(metric.Value()), nil
+	case metrics.GaugeFloat64:
+		return float64(metric.Value()), nil
+	case metrics.Gauge:
+		return float64(metric.Value()), nil
+	case metrics.Counter:
+		return float64(metric.Count()), nil
+	}
+
+	return 0.0, fmt.Errorf("metric '%s' has %w: %s", name, ErrUnknownMetricType, reflect.TypeOf(i))
+}
+
+// ErrUnknownMetricType is returned, possibly wrapped, by converters for
+// metrics of a type they cannot convert.
+var ErrUnknownMetricType = errors.New("unknown type")
+
+// ErrNonFiniteValue is returned, wrapped, for metrics converted to NaN or an
+// infinite value unless PropagateNonFinite is enabled.
+var ErrNonFiniteValue = errors.New("non finite value")
+
+// ErrCardinalityExceeded is returned, wrapped, for metrics that would add a
+// series to a name already exporting MaxSeriesPerMetric series.
+var ErrCardinalityExceeded = errors.New("too many series")
+
+// ErrSkipMetric is returned, possibly wrapped, by converters to keep the
+// value exported for a metric by the previous flush.
+var ErrSkipMetric = errors.New("skip metric")
+
+// ErrRemoveMetric is returned, possibly wrapped, by converters to remove the
+// series of a metric until it is converted successfully again.
+var ErrRemoveMetric = errors.New("remove metric")
+
+// ConverterChain converts metrics with the first of the given converters
+// that knows their type, i.e. does not fail with ErrUnknownMetricType.
+func ConverterChain(converters ...MetricConverter) optSetter {
+	return func(c *PrometheusConfig) error {
+		c.converter = func(name string, i interface{}) (float64, error) {
+			err := fmt.Errorf("metric '%s' has %w: %s", name, ErrUnknownMetricType, reflect.TypeOf(i))
+			for _, convert := range converters {
+				var value float64
+				value, err = convert(name, i)
+				if !errors.Is(err, ErrUnknownMetricType) {
+					return value, err
+				}
+			}
+			return 0.0, err
+		}
+		return nil
+	}
+}
+
+func DefaultKeyNormalizer(key string) string {
+	key = strings.Replace(key, " ", "_", -1)
+	key = strings.Replace(key, ".", "_", -1)
+	key = strings.Replace(key, "-", "_", -1)
+	key = strings.Replace(key, "=", "_", -1)
+
+	return key
+}
+
+func LowerCaseKeyNormalizer(key string) string { return strings.ToLower(DefaultKeyNormalizer(key)) }
+
+// NewPrometheusProvider returns a Provider that produces Prometheus metrics.
+// Namespace and Subsystem are applied to all produced metrics.
+func NewPrometheusProvider(r metrics.Registry, namespace string, subsystem string, promRegistry prometheus.Registerer, setters ...optSetter) (*PrometheusConfig, error) {
+	return NewPrometheusProviderFromConfig(Config{
+		Registry:     r,
+		PromRegistry: promRegistry,
+		Namespace:    namespace,
+		Subsystem:    subsystem,
+	}, setters...)
+}
+
+// Config holds the settings of a provider that can be read from a
+// configuration file, for NewPrometheusProviderFromConfig. Zero values select
+// the defaults.
+type Config struct {
+	Registry      metrics.Registry      // registry to export, metrics.DefaultRegistry if nil
+	PromRegistry  prometheus.Registerer // registry to export to, prometheus.DefaultRegisterer if nil
+	Namespace     string
+	Subsystem     string
+	FlushInterval time.Duration     // 15 seconds if zero
+	FlushTimeout  time.Duration     // see FlushTimeout, no timeout if zero
+	ConstLabels   map[string]string // see ConstLabels
+}
+
+// NewPrometheusProviderFromConfig returns a Provider configured by config.
+// The given options are applied after config and override it.
+func NewPrometheusProviderFromConfig(config Config, setters ...optSetter) (*PrometheusConfig, error) {
+	if config.Registry == nil {
+		config.Registry = metrics.DefaultRegistry
+	}
+	if config.PromRegistry == nil {
+		config.PromRegistry = prometheus.DefaultRegisterer
+	}
+	if config.FlushInterval < 0 {
+		return nil, fmt.Errorf("flush interval must not be negative, got %s", config.FlushInterval)
+	}
+	if config.FlushInterval == 0 {
+		config.FlushInterval = 15 * time.Second
+	}
+	conf := &PrometheusConfig{
+		started:            time.Now(),
+		lastFlushOK:        1,
+		stopCh:             make(chan struct{}),
+		resetCh:            make(chan struct{}, 1),
+		Namespace:          config.Namespace,
+		Subsystem:          config.Subsystem,
+		registry:           config.Registry,
+		promRegistry:       config.PromRegistry,
+		FlushInterval:      config.FlushInterval,
+		gauges:             make(map[string]prometheus.Gauge),
+		changes:            make(map[string]*change),
+		histograms:         make(map[string]*histogramCollector),
+		constLabels:        prometheus.Labels{},
+		summaries:          make(map[string]*summaryCollector),
+		kinds:              make(map[string]PromType),
+		counters:           make(map[string]prometheus.Counter),
+		counterTotal:       make(map[string]float64),
+		created:            make(map[string]time.Time),
+		untyped:            make(map[string]*untypedCollector),
+		pendingKinds:       make(map[string]*pendingKind),
+		kindStableAfter:    1,
+		registryName:       "default",
+		tenantSegment:      -1,
+		staleMultiplier:    2,
+		sampleRate:         1,
+		timerQuantiles:     defaultTimerPercentiles,
+		histogramQuantiles: []float64{0.5, 0.9, 0.99},
+		timerUnit:          time.Nanosecond,
+		seen:               make(map[string]time.Time),
+		series:             make(map[string]int),
+		derived:            make(map[string]map[string]PromType),
+		adopted:            make(map[prometheus.Collector]bool),
+		gaugeVecs:          make(map[string]*prometheus.GaugeVec),
+		vecSeries:          make(map[string]vecSeries),
+		summaryObjectives:  DefaultSummaryObjectives,
+		converter:          DefaultMetricConverter,
+		keyNormalizer:      DefaultKeyNormalizer,
+		names:              make(map[string]*promName),
+	}
+
+	setters = append([]optSetter{FlushTimeout(config.FlushTimeout), ConstLabels(config.ConstLabels)}, setters...)
+	for _, s := range setters {
+		if err := s(conf); err != nil {
+			return nil, err
+		}
+	}
+
+	conf.namespace = conf.normalizeComponent(conf.Namespace)
+	conf.subsystem = conf.normalizeComponent(conf.Subsystem)
+	if err := conf.validateComponents(); err != nil {
+		return nil, err
+	}
+
+	if conf.instanceFromHost && conf.instance == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve instance label: %s", err)
+		}
+		conf.instance = host
+	}
+	if conf.instance != "" {
+		conf.constLabels["instance"] = conf.instance
+	}
+
+	if conf.isolated {
+		conf.promRegistry = prometheus.NewRegistry()
+	}
+
+	if conf.buildInfo != nil {
+		if err := conf.registerBuildInfo(); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, fn := range conf.gaugeFuncs {
+		g := prometheus.NewGaugeFunc(prometheus.GaugeOpts(conf.metricOpts(name, conf.constLabels)), fn)
+		if err := conf.registerStatic(g); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.selfMetrics {
+		self, err := newSelfMetrics(conf)
+		if err != nil {
+			return nil, err
+		}
+		conf.self = self
+	}
+
+	return conf, nil
+}
+
+// SetConverter replaces the converter of the provider, taking effect from
+// the next flush on. The series already exported keep their names and types,
+// so a converter returning values of a different meaning changes the
+// semantics of existing series.
+func (c *PrometheusConfig) SetConverter(converter MetricConverter) {
+	c.mu.Lock()
+	c.converter = converter
+	c.mu.Unlock()
+}
+
+// registerStatic registers a collector that is not exported for a go-metrics
+// metric, like the build info, so Close unregisters it along with the rest.
+func (c *PrometheusConfig) registerStatic(collector prometheus.Collector) error {
+	if err := c.promRegistry.Register(collector); err != nil {
+		return err
+	}
+	c.static = append(c.static, collector)
+	return nil
+}
+
+// unregister unregisters a collector the provider registered. A collector
+// it took over from others is only forgotten.
+func (c *PrometheusConfig) unregister(collector prometheus.Collector) bool {
+	if c.adopted[collector] {
+		delete(c.adopted, collector)
+		return true
+	}
+	return c.promRegistry.Unregister(collector)
+}
+
+// Close stops the flush loop and unregisters every collector the provider
+// registered, leaving the other collectors of the Prometheus registry in
+// place. Gauges registered by others and taken over by the provider, e.g.
+// by another provider of the same registry, stay registered. The provider
+// must not be flushed after Close.
+func (c *PrometheusConfig) Close() error {
+	c.Stop()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	collectors := c.static
+	for _, g := range c.gauges {
+		collectors = append(collectors, g)
+	}
+	for _, v := range c.gaugeVecs {
+		collectors = append(collectors, v)
+	}
+	for _, cn := range c.counters {
+		collectors = append(collectors, cn)
+	}
+	for _, h := range c.histograms {
+		collectors = append(collectors, h)
+	}
+	for _, s := range c.summaries {
+		collectors = append(collectors, s)
+	}
+	for _, u := range c.untyped {
+		collectors = append(collectors, u)
+	}
+	failed := 0
+	for _, collector := range collectors {
+		if !c.unregister(collector) {
+			failed++
+		}
+	}
+
+	c.static = nil
+	c.adopted = make(map[prometheus.Collector]bool)
+	c.gauges = make(map[string]prometheus.Gauge)
+	c.gaugeVecs = make(map[string]*prometheus.GaugeVec)
+	c.vecSeries = make(map[string]vecSeries)
+	c.counters = make(map[string]prometheus.Counter)
+	c.counterTotal = make(map[string]float64)
+	c.histograms = make(map[string]*histogramCollector)
+	c.summaries = make(map[string]*summaryCollector)
+	c.untyped = make(map[string]*untypedCollector)
+	c.kinds = make(map[string]PromType)
+	c.pendingKinds = make(map[string]*pendingKind)
+	c.seen = make(map[string]time.Time)
+	c.series = make(map[string]int)
+	c.derived = make(map[string]map[string]PromType)
+	c.changes = make(map[string]*change)
+	if failed > 0 {
+		return fmt.Errorf("%d collectors were not registered", failed)
+	}
+	return nil
+}
+
+// Gatherer returns the Prometheus registry the provider's metrics are
+// registered in, or nil if that registry cannot be gathered from.
+func (c *PrometheusConfig) Gatherer() prometheus.Gatherer {
+	g, _ := c.promRegistry.(prometheus.Gatherer)
+	return g
+}
+
+// FlushAndGather runs a single flush and gathers the Prometheus registry
+// right after, so tests can assert on the exported metrics without waiting
+// for the flush loop. The registry is gathered even if the flush failed.
+func (c *PrometheusConfig) FlushAndGather() ([]*dto.MetricFamily, error) {
+	g := c.Gatherer()
+	if g == nil {
+		return nil, errors.New("prometheus registry is not a gatherer")
+	}
+	err := c.UpdatePrometheusMetricsOnce()
+	families, gatherErr := g.Gather()
+	if err == nil {
+		err = gatherErr
+	}
+	return families, err
+}
+
+// metricKey identifies the collector exported for name with the given
+// labels. It starts with the fully qualified name of the exported metric, so
+// empty namespaces and subsystems are left out just like in the name.
+func (c *PrometheusConfig) metricKey(name string, labels prometheus.Labels) string {
+	key := c.fqName(name)
+	var pairs []string
+	for k, v := range labels {
+		if constValue, ok := c.constLabels[k]; !ok || constValue != v {
+			pairs = append(pairs, k+"="+v)
+		}
+	}
+	if len(pairs) == 0 {
+		return key
+	}
+	sort.Strings(pairs)
+	return key + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (c *PrometheusConfig) gaugeFromNameAndValue(name string, val float64, labels prometheus.Labels) error {
+	if err := c.setGauge(name, c.transformed(name, val), labels); err != nil {
+		return err
+	}
+	changed := c.trackChange(name, val, labels)
+	if c.sinceUpdate {
+		return c.setGauge(name+"_seconds_since_update", time.Since(changed).Seconds(), labels)
+	}
+	return nil
+}
+
+// transformed returns the value of a gauge after ValueTransform.
+func (c *PrometheusConfig) transformed(name string, val float64) float64 {
+	if c.transform != nil {
+		return c.transform(name, val)
+	}
+	return val
+}
+
+// change is the last value exported for a series and when it changed.
+type change struct {
+	name  string // metric name the series is exported for
+	value float64
+	at    time.Time
+}
+
+// trackChange records when the value exported for the series of name with
+// the given labels last changed, and returns that time.
+func (c *PrometheusConfig) trackChange(name string, val float64, labels prometheus.Labels) time.Time {
+	key := c.metricKey(name, labels)
+	last, ok := c.changes[key]
+	if !ok || last.value != val {
+		last = &change{name: name, value: val, at: time.Now()}
+		c.changes[key] = last
+	}
+	return last.at
+}
+
+func (c *PrometheusConfig) setGauge(name string, val float64, labels prometheus.Labels) error {
+	key := c.metricKey(name, labels)
+	g, ok := c.gauges[key]
+	if !ok {
+		collector, err := c.register(name, prometheus.NewGauge(prometheus.GaugeOpts(c.metricOpts(name, labels))))
+		if err != nil {
+			return err
+		}
+		g = collector.(prometheus.Gauge)
+		c.gauges[key] = g
+		c.derive(key, GaugeType)
+	}
+	g.Set(val)
+	return nil
+}
+
+func (c *PrometheusConfig) gaugeVecFromName(name string, labelNames []string, labels prometheus.Labels) (*prometheus.GaugeVec, error) {
+	key := c.metricKey(name, labels)
+	vec, ok := c.gaugeVecs[key]
+	if !ok {
+		collector, err := c.register(name, prometheus.NewGaugeVec(prometheus.GaugeOpts(c.metricOpts(name, labels)), labelNames))
+		if err != nil {
+			return nil, err
+		}
+		vec = collector.(*prometheus.GaugeVec)
+		c.gaugeVecs[key] = vec
+	}
+	return vec, nil
+}
+
+// vecSeries is a series of a gauge vec, identified by its label values.
+type vecSeries struct {
+	vec    *prometheus.GaugeVec
+	values []string
+}
+
+// gaugeVecFromNameAndValue exports the metric as the series of a gauge vec
+// shared by every metric with the same name, with the labels parsed from its
+// name as variable labels.
+func (c *PrometheusConfig) gaugeVecFromNameAndValue(m namedMetric, val float64) error {
+	constLabels := prometheus.Labels{}
+	for k, v := range m.labels {
+		constLabels[k] = v
+	}
+	values := make([]string, len(m.labelNames))
+	for i, k := range m.labelNames {
+		values[i] = m.labels[k]
+		delete(constLabels, k)
+	}
+	vec, err := c.gaugeVecFromName(m.name, m.labelNames, constLabels)
+	if err != nil {
+		return err
+	}
+	g, err := vec.GetMetricWithLabelValues(values...)
+	if err != nil {
+		return fmt.Errorf("metric '%s' cannot be exported: %w", m.name, err)
+	}
+	g.Set(c.transformed(m.name, val))
+	c.vecSeries[c.metricKey(m.name, m.labels)] = vecSeries{vec: vec, values: values}
+	c.trackChange(m.name, val, m.labels)
+	return nil
+}
+
+// register registers the collector of metric name with the Prometheus
+// registry. If an equal gauge was already registered, e.g. by another
+// provider sharing the registry or by hand before the first flush, that one
+// is returned instead, as setting it does not depend on its previous value.
+// The provider never unregisters a collector it took over.
+// Any other collector already registered, e.g. a counter whose total is
+// advanced by another exporter or a counter registered under the name of a
+// gauge, is an error.
+func (c *PrometheusConfig) register(name string, collector prometheus.Collector) (prometheus.Collector, error) {
+	err := c.promRegistry.Register(collector)
+	if err == nil {
+		return collector, nil
+	}
+	are, ok := err.(prometheus.AlreadyRegisteredError)
+	if !ok {
+		return nil, fmt.Errorf("metric '%s' cannot be registered: %w", name, err)
+	}
+	if reflect.TypeOf(are.ExistingCollector) != reflect.TypeOf(collector) {
+		return nil, fmt.Errorf("metric '%s' is already registered as %T", name, are.ExistingCollector)
+	}
+	switch collector.(type) {
+	case prometheus.Gauge, *prometheus.GaugeVec:
+		c.adopted[are.ExistingCollector] = true
+		return are.ExistingCollector, nil
+	}
+	return nil, fmt.Errorf("metric '%s' is already registered by another collector", name)
+}
+
+// percentilesFromNameAndSnapshot exports the configured percentiles of a
+// histogram as gauges labeled with their quantile, plus its variance if
+// enabled.
+func (c *PrometheusConfig) percentilesFromNameAndSnapshot(name string, snapshot metrics.Histogram, labels prometheus.Labels) error {
+	vec, err := c.gaugeVecFromName(name, []string{"quantile"}, labels)
+	if err != nil {
+		return err
+	}
+	for i, p := range percentiles(snapshot, c.percentiles, c.emptyAsNaN) {
+		vec.WithLabelValues(strconv.FormatFloat(c.percentiles[i], 'f', -1, 64)).Set(p)
+	}
+	if c.variance {
+		return c.gaugeFromNameAndValue(name+"_variance", snapshot.Variance(), labels)
+	}
+	return nil
+}
+
+// meterSeriesFromNameAndSnapshot exports the MeterSeries of a meter, all
+// taken from the same snapshot.
+func (c *PrometheusConfig) meterSeriesFromNameAndSnapshot(name string, snapshot metrics.Meter, labels prometheus.Labels) error {
+	for _, suffix := range c.meterSeries {
+		var err error
+		if suffix == "count" {
+			err = c.counterFromNameAndValue(name+"_count", float64(snapshot.Count()), labels)
+		} else if !c.warmingUp() {
+			err = c.gaugeFromNameAndValue(name+"_"+suffix, meterSeries[suffix](snapshot), labels)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultTimerPercentiles are the percentiles of timers exported by
+// TimerFamilies unless Percentiles is set.
+var defaultTimerPercentiles = []float64{0.5, 0.75, 0.95, 0.99, 0.999}
+
+// timerFamilyFromNameAndSnapshot exports the rate and latency percentiles of
+// a timer as a single gauge family labeled with kind and quantile.
+func (c *PrometheusConfig) timerFamilyFromNameAndSnapshot(name string, snapshot metrics.Timer, labels prometheus.Labels) error {
+	vec, err := c.gaugeVecFromName(name, []string{"kind", "quantile"}, labels)
+	if err != nil {
+		return err
+	}
+	if !c.warmingUp() {
+		vec.WithLabelValues("rate", "").Set(snapshot.Rate1())
+	}
+	qs := c.percentiles
+	if qs == nil {
+		qs = defaultTimerPercentiles
+	}
+	for i, p := range percentiles(snapshot, qs, c.emptyAsNaN) {
+		vec.WithLabelValues("latency_seconds", strconv.FormatFloat(qs[i], 'f', -1, 64)).Set(p / float64(time.Second))
+	}
+	return nil
+}
+
+// enumFromNameAndValue sets the series of the state val maps to to 1 and the
+// series of every other state to 0.
+func (c *PrometheusConfig) enumFromNameAndValue(name string, val int64, states map[int64]string, labels prometheus.Labels) error {
+	vec, err := c.gaugeVecFromName(name, []string{"state"}, labels)
+	if err != nil {
+		return err
+	}
+	for v, state := range states {
+		vec.WithLabelValues(state).Set(boolToFloat(v == val))
+	}
+	if _, ok := states[val]; !ok {
+		return fmt.Errorf("metric '%s' has value %d without a mapped state", name, val)
+	}
+	return nil
+}
+
+// ExportChangedSince returns the names of the metrics with a series whose
+// exported value changed after t. It only reports and does not alter what
+// gets exported.
+func (c *PrometheusConfig) ExportChangedSince(t time.Time) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changed := make(map[string]bool)
+	for _, ch := range c.changes {
+		if ch.at.After(t) {
+			changed[ch.name] = true
+		}
+	}
+	var names []string
+	for name := range changed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ExportedValues returns the values the gauges and counters of the provider
+// were last set to, keyed by their fully qualified name followed by their
+// labels extracted from the metric name, if any. Like ExportChangedSince it
+// does not alter what gets exported.
+func (c *PrometheusConfig) ExportedValues() map[string]float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	values := make(map[string]float64, len(c.gauges)+len(c.counters))
+	for key, g := range c.gauges {
+		var m dto.Metric
+		if err := g.Write(&m); err == nil {
+			values[key] = m.GetGauge().GetValue()
+		}
+	}
+	for key, total := range c.counterTotal {
+		values[key] = total
+	}
+	return values
+}
+
+func (c *PrometheusConfig) bucketsFor(name string) []float64 {
+	if buckets, ok := c.histogramBuckets[name]; ok {
+		return buckets
+	}
+	if c.defaultBuckets != nil {
+		return c.defaultBuckets
+	}
+	return prometheus.DefBuckets
+}
+
+func (c *PrometheusConfig) histogramFromNameAndSnapshot(name string, snapshot metrics.Histogram, labels prometheus.Labels) error {
+	key := c.metricKey(name, labels)
+	h, ok := c.histograms[key]
+	if !ok {
+		collector, err := c.register(name, newHistogramCollector(prometheus.NewDesc(
+			c.fqName(name),
+			name, nil, labels,
+		), c.bucketsFor(name)))
+		if err != nil {
+			return err
+		}
+		h = collector.(*histogramCollector)
+		c.histograms[key] = h
+		c.derive(key, HistogramType)
+	}
+	h.update(snapshot.Sample().Values())
+	return nil
+}
+
+func (c *PrometheusConfig) summaryFromNameAndSnapshot(name string, snapshot distribution, labels prometheus.Labels) error {
+	key := c.metricKey(name, labels)
+	s, ok := c.summaries[key]
+	if !ok {
+		opts := c.metricOpts(name, labels)
+		collector, err := c.register(name, newSummaryCollector(prometheus.SummaryOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
+			Name:        opts.Name,
+			Help:        opts.Help,
+			ConstLabels: opts.ConstLabels,
+			Objectives:  c.summaryObjectives,
+		}))
+		if err != nil {
+			return err
+		}
+		s = collector.(*summaryCollector)
+		c.summaries[key] = s
+		c.derive(key, SummaryType)
+	}
+	s.update(snapshot, c.emptyAsNaN)
+	return nil
+}
+
+// export updates the Prometheus collector of the given type for a metric.
+func (c *PrometheusConfig) export(m namedMetric, kind PromType) error {
+	name, i := m.name, m.metric
+	switch kind {
+	case HistogramType:
+		h, ok := i.(metrics.Histogram)
+		if !ok {
+			return fmt.Errorf("metric '%s' of type %s cannot be exported as a histogram", name, reflect.TypeOf(i))
+		}
+		return c.histogramFromNameAndSnapshot(name, h.Snapshot(), m.labels)
+	case SummaryType:
+		switch metric := i.(type) {
+		case metrics.Timer:
+			return c.summaryFromNameAndSnapshot(name, metric.Snapshot(), m.labels)
+		case metrics.Histogram:
+			return c.summaryFromNameAndSnapshot(name, metric.Snapshot(), m.labels)
+		default:
+			return fmt.Errorf("metric '%s' of type %s cannot be exported as a summary", name, reflect.TypeOf(i))
+		}
+	}
+
+	if t, ok := i.(metrics.Timer); ok && kind == GaugeType && c.timerCounts {
+		if err := c.counterFromNameAndValue(name+"_count", float64(t.Count()), m.labels); err != nil {
+			return err
+		}
+	}
+
+	if states, ok := c.enumMappings[name]; ok && kind == GaugeType {
+		if g, ok := i.(metrics.Gauge); ok {
+			return c.enumFromNameAndValue(name, g.Value(), states, m.labels)
+		}
+	}
+
+	if meter, ok := i.(metrics.Meter); ok && c.meterCounters {
+		return c.meterCounterFromNameAndSnapshot(name, meter.Snapshot(), m.labels)
+	}
+
+	if meter, ok := i.(metrics.Meter); ok && kind == GaugeType && c.meterSeries != nil {
+		return c.meterSeriesFromNameAndSnapshot(name, meter.Snapshot(), m.labels)
+	}
+
+	if t, ok := i.(metrics.Timer); ok && kind == GaugeType && c.timerStats {
+		return c.timerStatsFromNameAndSnapshot(name, t.Snapshot(), m.labels)
+	}
+
+	if t, ok := i.(metrics.Timer); ok && kind == GaugeType && c.timerFamily {
+		return c.timerFamilyFromNameAndSnapshot(name, t.Snapshot(), m.labels)
+	}
+
+	if h, ok := i.(metrics.Histogram); ok && kind == GaugeType && c.histogramStats {
+		return c.histogramStatsFromNameAndSnapshot(name, h.Snapshot(), m.labels)
+	}
+
+	if h, ok := i.(metrics.Histogram); ok && kind == GaugeType && c.percentiles != nil {
+		return c.percentilesFromNameAndSnapshot(name, h.Snapshot(), m.labels)
+	}
+
+	switch i.(type) {
+	case metrics.Meter, metrics.Timer:
+		if c.warmingUp() {
+			return nil
+		}
+	}
+
+	value, err := c.convert(name, i)
+	switch {
+	case errors.Is(err, ErrSkipMetric):
+		return nil
+	case errors.Is(err, ErrRemoveMetric):
+		c.removeMetric(c.metricKey(name, m.labels))
+		return nil
+	case err != nil:
+		return err
+	}
+	if !c.nonFinite && (math.IsNaN(value) || math.IsInf(value, 0)) {
+		return fmt.Errorf("metric '%s' has %w: %g", name, ErrNonFiniteValue, value)
+	}
+	c.checkUnit(name, value)
+	switch kind {
+	case CounterType:
+		return c.counterFromNameAndValue(name, value, m.labels)
+	case UntypedType:
+		return c.untypedFromNameAndValue(name, value, m.labels)
+	default:
+		if m.labelNames != nil {
+			return c.gaugeVecFromNameAndValue(m, value)
+		}
+		return c.gaugeFromNameAndValue(name, value, m.labels)
+	}
+}
+
+// warmingUp reports whether rates are not exported yet because of
+// RateWarmup.
+func (c *PrometheusConfig) warmingUp() bool {
+	return time.Since(c.started) < c.rateWarmup
+}
+
+func (c *PrometheusConfig) warnf(format string, args ...interface{}) {
+	if c.logf != nil {
+		c.logf(format, args...)
+	}
+}
+
+// checkUnit warns about values too large for the unit their name suggests.
+func (c *PrometheusConfig) checkUnit(name string, value float64) {
+	if c.unitLimits == nil {
+		return
+	}
+	fqName := c.fqName(name)
+	for suffix, limit := range c.unitLimits {
+		if strings.HasSuffix(fqName, suffix) && math.Abs(value) > limit {
+			c.warnf("metric '%s' has value %g larger than %g, check it is exported in the unit of its %s suffix", fqName, value, limit, suffix)
+		}
+	}
+}
+
+// ErrAlreadyRunning is returned by Run when the flush loop of the provider is
+// already running.
+var ErrAlreadyRunning = errors.New("flush loop already running")
+
+// UpdatePrometheusMetrics flushes the registry every flush interval until
+// Stop is called. It returns at once if the flush loop is already running.
+func (c *PrometheusConfig) UpdatePrometheusMetrics() {
+	c.Run(context.Background())
+}
+
+// Run flushes the registry every flush interval until ctx is done, returning
+// ctx.Err(), or until Stop is called, returning nil. A flush running when ctx
+// is done is stopped early. Only one flush loop runs at a time, Run returns
+// ErrAlreadyRunning while another one is running.
+func (c *PrometheusConfig) Run(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&c.running, 0, 1) {
+		return ErrAlreadyRunning
+	}
+	defer atomic.StoreInt32(&c.running, 0)
+	if c.flushOnStart {
+		c.runFlush(ctx)
+	}
+	wait := c.startupDelay
+	if wait <= 0 {
+		wait = c.nextFlushInterval()
+	}
+	for {
+		tick, stop := c.tick(wait + c.nextJitter())
+		select {
+		case <-ctx.Done():
+			stop()
+			return ctx.Err()
+		case <-c.stopCh:
+			stop()
+			return nil
+		case <-c.resetCh:
+			stop()
+		case <-tick:
+			c.runFlush(ctx)
+		}
+		wait = c.nextFlushInterval()
+	}
+}
+
+// nextJitter returns the random duration added to the next wait of the flush
+// loop.
+func (c *PrometheusConfig) nextJitter() time.Duration {
+	if c.jitter <= 0 {
+		return 0
+	}
+	return time.Duration(c.jitterRand.Int63n(int64(c.jitter)))
+}
+
+// tick returns a channel receiving a value once d has passed, and a function
+// releasing it.
+func (c *PrometheusConfig) tick(d time.Duration) (<-chan time.Time, func()) {
+	if c.ticker != nil {
+		return c.ticker(d), func() {}
+	}
+	timer := time.NewTimer(d)
+	return timer.C, func() { timer.Stop() }
+}
+
+// Stop ends the flush loops of UpdatePrometheusMetrics and Run. Calling it
+// more than once has no effect.
+func (c *PrometheusConfig) Stop() {
+	c.stopOnce.Do(func() { close(c.stopCh) })
+}
+
+// SetFlushInterval changes the flush interval of a running or future flush
+// loop. A running loop waits the new interval from now on before its next
+// flush, a flush in progress completes first.
+func (c *PrometheusConfig) SetFlushInterval(interval time.Duration) {
+	c.mu.Lock()
+	c.FlushInterval = interval
+	c.mu.Unlock()
+	select {
+	case c.resetCh <- struct{}{}:
+	default:
+	}
+}
+
+func (c *PrometheusConfig) nextFlushInterval() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.interval()
+}
+
+// interval returns the current flush interval, the one of FlushIntervalFunc
+// if set. The caller must hold c.mu.
+func (c *PrometheusConfig) interval() time.Duration {
+	if c.flushInterval != nil {
+		return c.flushInterval()
+	}
+	return c.FlushInterval
+}
+
+type namedMetric struct {
+	name       string
+	metric     interface{}
+	labels     prometheus.Labels // const labels of the exported metric
+	labelNames []string          // labels parsed from the name, variable in gauge vecs
+	source     string            // name of the registry of the metric
+	kind       *PromType         // type read from the name, nil if inferred
+	err        error             // why the metric cannot be exported
+}
+
+type sourceRegistry struct {
+	name     string
+	registry metrics.Registry
+}
+
+// sources returns every go-metrics registry exported by the provider.
+func (c *PrometheusConfig) sources() []sourceRegistry {
+	return append([]sourceRegistry{{name: c.registryName, registry: c.registry}}, c.extraRegistries...)
+}
+
+// sourceLabels returns the const labels of metrics from the given registry.
+func (c *PrometheusConfig) sourceLabels(source string) prometheus.Labels {
+	if c.sourceLabel == "" {
+		return c.constLabels
+	}
+	labels := prometheus.Labels{c.sourceLabel: source}
+	for k, v := range c.constLabels {
+		labels[k] = v
+	}
+	return labels
+}
+
+func (c *PrometheusConfig) newNamedMetric(name string, i interface{}, labels prometheus.Labels) namedMetric {
+	if c.typeLabel != "" {
+		withType := prometheus.Labels{c.typeLabel: metricTypeName(i)}
+		for k, v := range labels {
+			withType[k] = v
+		}
+		labels = withType
+	}
+	m := namedMetric{name: name, metric: i, labels: labels}
+	if c.labelParser != nil {
+		if base, parsed := c.labelParser(name); len(parsed) > 0 {
+			// the labels are not added if they were folded into the name
+			if m = c.withLabels(m, base, parsed); m.name == base {
+				for k := range parsed {
+					m.labelNames = append(m.labelNames, k)
+				}
+				sort.Strings(m.labelNames)
+			}
+		}
+	}
+	if c.typeSuffixes {
+		m = typeFromSuffix(m)
+	}
+	if c.tenantSegment >= 0 {
+		m = c.extractTenant(m)
+	}
+	return m
+}
+
+// typeSuffixes are the name suffixes recognized by TypeFromNameSuffix.
+var typeSuffixes = map[string]PromType{
+	".counter":   CounterType,
+	".gauge":     GaugeType,
+	".histogram": HistogramType,
+}
+
+// typeFromSuffix strips a type suffix from the metric name and exports the
+// metric as that type.
+func typeFromSuffix(m namedMetric) namedMetric {
+	for suffix, kind := range typeSuffixes {
+		if strings.HasSuffix(m.name, suffix) && len(m.name) > len(suffix) {
+			kind := kind
+			m.name = strings.TrimSuffix(m.name, suffix)
+			m.kind = &kind
+			return m
+		}
+	}
+	return m
+}
+
+// extractTenant moves the tenant segment of the metric name into a label.
+func (c *PrometheusConfig) extractTenant(m namedMetric) namedMetric {
+	segments := strings.Split(m.name, ".")
+	if len(segments) <= c.tenantSegment+1 {
+		return m
+	}
+	name := strings.Join(append(segments[:c.tenantSegment:c.tenantSegment], segments[c.tenantSegment+1:]...), ".")
+	return c.withLabels(m, name, prometheus.Labels{"tenant": segments[c.tenantSegment]})
+}
+
+// withLabels renames the metric to name and adds the labels extracted from
+// its name, unless that exceeds MaxLabels.
+func (c *PrometheusConfig) withLabels(m namedMetric, name string, labels prometheus.Labels) namedMetric {
+	extracted := m
+	extracted.name = name
+	extracted.labels, extracted.err = c.mergeLabels(name, m.labels, labels)
+	if c.maxLabels > 0 && len(extracted.labels) > c.maxLabels {
+		if c.foldLabels {
+			return m
+		}
+		extracted.err = fmt.Errorf("metric '%s' has %d labels, more than the maximum of %d", m.name, len(extracted.labels), c.maxLabels)
+	}
+	return extracted
+}
+
+// mergeLabels adds the labels extracted from the name of a metric to its
+// const labels, resolving labels defined by both with the LabelConflict
+// policy.
+func (c *PrometheusConfig) mergeLabels(name string, constLabels, extracted prometheus.Labels) (prometheus.Labels, error) {
+	labels := prometheus.Labels{}
+	for k, v := range constLabels {
+		labels[k] = v
+	}
+	for k, v := range extracted {
+		if _, ok := labels[k]; ok {
+			switch c.labelConflict {
+			case ConstWins:
+				continue
+			case ConflictError:
+				return nil, fmt.Errorf("metric '%s' has label '%s' both extracted from its name and const", name, k)
+			}
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// snapshot collects the metrics of the registries before any of them is
+// processed, so metrics registered or removed while a flush is running
+// never interfere with the iteration. It also returns the number of metrics
+// registered, including those not selected for export.
+func (c *PrometheusConfig) snapshot() (snapshot []namedMetric, registered int) {
+	for _, source := range c.sources() {
+		labels := c.sourceLabels(source.name)
+		var metrics []namedMetric
+		source.registry.Each(func(name string, i interface{}) {
+			registered++
+			if m, ok := c.entry(name, i, labels); ok {
+				m.source = source.name
+				metrics = append(metrics, m)
+			}
+		})
+		sort.Slice(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+		snapshot = append(snapshot, metrics...)
+	}
+	return snapshot, registered
+}
+
+// entry returns the metric exported for an entry of a registry, unless it is
+// not selected. If RecoverPanics is enabled, a panic, e.g. in a MetricFilter
+// or LabelParser, is returned as the error of the metric instead of
+// crashing the flush.
+func (c *PrometheusConfig) entry(name string, i interface{}, labels prometheus.Labels) (m namedMetric, ok bool) {
+	if c.recoverPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				m = namedMetric{name: name, metric: i, labels: labels, err: fmt.Errorf("metric '%s' panicked: %v", name, r)}
+				ok = true
+			}
+		}()
+	}
+	if !c.selected(name, i) {
+		return namedMetric{}, false
+	}
+	return c.newNamedMetric(name, i, labels), true
+}
+
+// selected reports whether the metric of the registries is exported.
+func (c *PrometheusConfig) selected(name string, i interface{}) bool {
+	if c.filter != nil && !c.filter(name) {
+		return false
+	}
+	if c.skipFuncs {
+		switch i.(type) {
+		case *metrics.FunctionalGauge, *metrics.FunctionalGaugeFloat64:
+			return false
+		}
+	}
+	return c.sampled(name)
+}
+
+// sampled reports whether the metric name is selected by SampleRate.
+func (c *PrometheusConfig) sampled(name string) bool {
+	if c.sampleRate >= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return float64(h.Sum32()) < c.sampleRate*(1<<32)
+}
+
+// process exports a metric as the Prometheus type it resolves to.
+func (c *PrometheusConfig) process(m namedMetric) error {
+	if m.err != nil {
+		return m.err
+	}
+	kind := c.promTypeOf(m.name, m.metric)
+	if m.kind != nil {
+		kind = *m.kind
+	}
+	fqName := c.fqName(m.name)
+	if !metricNameRE.MatchString(fqName) {
+		return fmt.Errorf("metric '%s' has invalid name '%s'", m.name, fqName)
+	}
+	key := c.metricKey(m.name, m.labels)
+	if _, ok := c.seen[key]; !ok {
+		if c.maxSeries > 0 && c.series[fqName] >= c.maxSeries {
+			return fmt.Errorf("metric '%s' has %w, '%s' already exports %d", m.name, ErrCardinalityExceeded, fqName, c.maxSeries)
+		}
+		c.series[fqName]++
+	}
+	c.seen[key] = time.Now()
+	if !c.stableKind(key, kind) {
+		return nil
+	}
+	c.exporting = key
+	defer func() { c.exporting = "" }()
+	return c.exportMetric(m, kind)
+}
+
+// claim records the metric as the one exporting its series in the flush, or
+// fails if another metric of the flush, e.g. from another registry or with a
+// name normalized the same way, already exported it.
+func (c *PrometheusConfig) claim(claimed map[string]namedMetric, m namedMetric) error {
+	key := c.metricKey(m.name, m.labels)
+	if other, ok := claimed[key]; ok {
+		return fmt.Errorf("metric '%s' of registry '%s' collides with metric '%s' of registry '%s'", m.name, m.source, other.name, other.source)
+	}
+	claimed[key] = m
+	return nil
+}
+
+// ExportMetric exports a single metric right away, without waiting for the
+// next flush to go through the whole registry.
+func (c *PrometheusConfig) ExportMetric(name string, metric interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := c.newNamedMetric(name, metric, c.sourceLabels(c.registryName))
+	if err := c.process(m); err != nil {
+		c.reportError(m.name, err)
+		return err
+	}
+	return nil
+}
+
+// reportError logs the reason a metric failed to export and passes it to
+// OnError.
+func (c *PrometheusConfig) reportError(name string, err error) {
+	c.warnf("%s", err)
+	if c.onError != nil {
+		c.onError(name, err)
+	}
+}
+
+// exportMetric exports a single metric, turning a panic into an error if
+// RecoverPanics is enabled. Every metric is applied to Prometheus right away,
+// so a panic never discards the metrics exported before it.
+func (c *PrometheusConfig) exportMetric(m namedMetric, kind PromType) (err error) {
+	if c.recoverPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("metric '%s' panicked: %v", m.name, r)
+			}
+		}()
+	}
+	return c.export(m, kind)
+}
+
+// StaleThreshold returns how long a metric may be missing from flushes
+// before its series is considered stale. It follows the current flush
+// interval, e.g. one changed by SetFlushInterval.
+func (c *PrometheusConfig) StaleThreshold() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.staleThreshold()
+}
+
+func (c *PrometheusConfig) staleThreshold() time.Duration {
+	if c.staleAfter > 0 {
+		return c.staleAfter
+	}
+	return time.Duration(float64(c.interval()) * c.staleMultiplier)
+}
+
+// removeStale removes the series of metrics not seen for longer than the
+// stale threshold.
+func (c *PrometheusConfig) removeStale(now time.Time) {
+	c.removeSeenBefore(now.Add(-c.staleThreshold()))
+}
+
+// removeSeenBefore removes the series of metrics last seen before t.
+func (c *PrometheusConfig) removeSeenBefore(t time.Time) {
+	for key, at := range c.seen {
+		if at.Before(t) {
+			c.warnf("removing stale metric '%s'", key)
+			c.removeMetric(key)
+		}
+	}
+}
+
+// removeMetric unregisters the series exported under key and forgets the
+// metric was ever seen.
+func (c *PrometheusConfig) removeMetric(key string) {
+	c.removeCollector(key, c.kinds[key])
+	delete(c.kinds, key)
+	delete(c.pendingKinds, key)
+	delete(c.seen, key)
+	c.forgetSeries(key)
+}
+
+// forgetSeries frees the slot of the series exported under key in the count
+// of series of its name.
+func (c *PrometheusConfig) forgetSeries(key string) {
+	fqName := key
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		fqName = key[:i]
+	}
+	if c.series[fqName]--; c.series[fqName] <= 0 {
+		delete(c.series, fqName)
+	}
+}
+
+// FlushTimeoutError is returned by a flush aborted by FlushTimeout.
+type FlushTimeoutError struct {
+	Timeout   time.Duration
+	Processed int // number of metrics processed before the flush was aborted
+	Total     int // number of metrics in the registry
+}
+
+func (e *FlushTimeoutError) Error() string {
+	return fmt.Sprintf("flush timed out after %s, processed %d of %d metrics", e.Timeout, e.Processed, e.Total)
+}
+
+// FlushError is returned by a flush that failed to export some of the
+// metrics. Every other metric was exported.
+type FlushError struct {
+	Errors []error // why each of the failed metrics was not exported
+}
+
+func (e *FlushError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("failed to export %d metrics: %s", len(e.Errors), strings.Join(messages, "; "))
+}
+
+// Is reports whether any of the errors of the flush matches target, e.g.
+// errors.Is(err, ErrUnknownMetricType).
+func (e *FlushError) Is(target error) bool {
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdatePrometheusMetricsOnce flushes the registry once. It is safe to call
+// concurrently with other flushes, including the flush loop, which all run
+// one after the other.
+func (c *PrometheusConfig) UpdatePrometheusMetricsOnce() error {
+	return c.updateOnce(context.Background())
+}
+
+// FlushNow flushes the registry once and returns why it failed, e.g. right
+// before shutting down. Like UpdatePrometheusMetricsOnce it is safe to call
+// while the flush loop is running.
+func (c *PrometheusConfig) FlushNow() error {
+	return c.UpdatePrometheusMetricsOnce()
+}
+
+// updateOnce flushes the registry within the flush timeout, stopping early
+// when ctx is done. A flush stopped by ctx rather than by the flush timeout
+// fails with ctx.Err().
+func (c *PrometheusConfig) updateOnce(ctx context.Context) error {
+	flushCtx := ctx
+	if c.flushTimeout > 0 {
+		var cancel context.CancelFunc
+		flushCtx, cancel = context.WithTimeout(ctx, c.flushTimeout)
+		defer cancel()
+	}
+	err := c.flush(flushCtx)
+	var timeout *FlushTimeoutError
+	if errors.As(err, &timeout) && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// runFlush flushes the registry for the flush loop. Metrics failing to
+// export are reported by the flush itself, a flush aborted by FlushTimeout
+// is reported here as nobody else receives the error.
+func (c *PrometheusConfig) runFlush(ctx context.Context) {
+	var timeout *FlushTimeoutError
+	if err := c.updateOnce(ctx); errors.As(err, &timeout) {
+		c.reportError("", err)
+	}
+}
+
+// flush exports every metric of the registry, stopping early when ctx is
+// done. Concurrent flushes run one after the other, so the values of a
+// metric are always exported in the order they were read in.
+func (c *PrometheusConfig) flush(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	start := time.Now()
+	snapshot, registered := c.snapshot()
+	var failed []error
+	var err error
+	processed := 0
+	claimed := make(map[string]namedMetric, len(snapshot))
+	for _, m := range snapshot {
+		if ctx.Err() != nil {
+			err = &FlushTimeoutError{Timeout: c.flushTimeout, Processed: processed, Total: len(snapshot)}
+			break
+		}
+		perr := c.claim(claimed, m)
+		if perr == nil {
+			perr = c.process(m)
+		}
+		if perr != nil {
+			c.reportError(m.name, perr)
+			failed = append(failed, perr)
+		}
+		processed++
+	}
+	if c.markStale {
+		c.removeStale(time.Now())
+	}
+	if c.removeMissing && err == nil {
+		c.removeSeenBefore(start)
+	}
+	successful := len(failed) == 0 && err == nil
+	if successful {
+		atomic.StoreInt32(&c.lastFlushOK, 1)
+	} else {
+		atomic.StoreInt32(&c.lastFlushOK, 0)
+	}
+	if c.self != nil {
+		c.self.sourceRegistrySize.Set(float64(registered))
+		c.self.lastFlushSuccessful.Set(boolToFloat(successful))
+		c.self.flushDuration.Set(time.Since(start).Seconds())
+		c.self.flushMetrics.Add(float64(processed))
+		c.self.flushErrors.Add(float64(len(failed)))
+		c.self.lastFlushTimestamp.Set(float64(time.Now().UnixNano()) / 1e9)
+	}
+	if err == nil && len(failed) > 0 {
+		err = &FlushError{Errors: failed}
+	}
+	return err
 }
@@ -1,21 +1,80 @@
 package prometheusmetrics
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"log"
+	"math"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/assert"
 )
 
+// fakeTicker makes the flush loop wait for ticks instead of a timer.
+func fakeTicker(ticks chan time.Time) optSetter {
+	return Ticker(func(time.Duration) <-chan time.Time { return ticks })
+}
+
+// flushOnTick runs the flush loop of pClient until it flushed on one tick.
+func flushOnTick(pClient *PrometheusConfig, ticks chan time.Time) {
+	done := make(chan struct{})
+	go func() {
+		pClient.UpdatePrometheusMetrics()
+		close(done)
+	}()
+	ticks <- time.Now()
+	pClient.Stop()
+	<-done
+}
+
 func TestPrometheusRegistration(t *testing.T) {
 	defaultRegistry := prometheus.DefaultRegisterer
 	pClient, _ := NewPrometheusProvider(metrics.DefaultRegistry, "test", "subsys", defaultRegistry, FlushRate(1*time.Second))
 	assert.Equal(t, pClient.promRegistry, defaultRegistry, "registries are different")
 }
 
+func TestNewPrometheusProviderFromConfig(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, err := NewPrometheusProviderFromConfig(Config{
+		Registry:     metricsRegistry,
+		PromRegistry: prometheusRegistry,
+		Namespace:    "test",
+		Subsystem:    "subsys",
+		ConstLabels:  map[string]string{"region": "eu"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 15*time.Second, pClient.FlushInterval, "the flush interval should default to 15s")
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Equal(t, "test_subsys_gauge", families[0].GetName())
+	assert.Equal(t, "region", families[0].GetMetric()[0].GetLabel()[0].GetName())
+
+	pClient, err = NewPrometheusProviderFromConfig(Config{FlushInterval: time.Minute}, FlushRate(time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second, pClient.FlushInterval, "options should override the config")
+	assert.Equal(t, metrics.DefaultRegistry, pClient.registry)
+	assert.Equal(t, prometheus.DefaultRegisterer, pClient.promRegistry)
+
+	_, err = NewPrometheusProviderFromConfig(Config{FlushInterval: -time.Second})
+	assert.Error(t, err)
+	_, err = NewPrometheusProviderFromConfig(Config{ConstLabels: map[string]string{"__reserved": "x"}})
+	assert.Error(t, err)
+}
+
 func TestUpdatePrometheusMetricsOnce(t *testing.T) {
 	prometheusRegistry := prometheus.NewRegistry()
 	metricsRegistry := metrics.NewRegistry()
@@ -34,11 +93,11 @@ func TestUpdatePrometheusMetricsOnce(t *testing.T) {
 
 func TestUpdatePrometheusMetrics(t *testing.T) {
 	prometheusRegistry := prometheus.NewRegistry()
+	ticks := make(chan time.Time)
 	metricsRegistry := metrics.NewRegistry()
-	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), fakeTicker(ticks))
 	metricsRegistry.Register("counter", metrics.NewCounter())
-	go pClient.UpdatePrometheusMetrics()
-	time.Sleep(2 * time.Second)
+	flushOnTick(pClient, ticks)
 	gauge := prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "test",
 		Subsystem: "subsys",
@@ -51,63 +110,143 @@ func TestUpdatePrometheusMetrics(t *testing.T) {
 
 func TestPrometheusCounterGetUpdated(t *testing.T) {
 	prometheusRegistry := prometheus.NewRegistry()
+	ticks := make(chan time.Time)
 	metricsRegistry := metrics.NewRegistry()
-	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), fakeTicker(ticks))
 	cntr := metrics.NewCounter()
 	metricsRegistry.Register("counter", cntr)
 	cntr.Inc(2)
-	go pClient.UpdatePrometheusMetrics()
 	cntr.Inc(13)
-	time.Sleep(5 * time.Second)
+	flushOnTick(pClient, ticks)
 	metrics, _ := prometheusRegistry.Gather()
 	serialized := fmt.Sprint(metrics[0])
+	expected := fmt.Sprintf("name:\"test_subsys_counter\" help:\"counter\" type:COUNTER metric:<counter:<value:%d > > ", cntr.Count())
+	assert.Equal(t, expected, serialized, "metrics differ")
+}
+
+func TestTreatCountersAsGauges(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), TreatCountersAsGauges(true))
+	cntr := metrics.NewCounter()
+	metricsRegistry.Register("counter", cntr)
+	cntr.Inc(15)
+	metrics, _ := pClient.FlushAndGather()
+	serialized := fmt.Sprint(metrics[0])
 	expected := fmt.Sprintf("name:\"test_subsys_counter\" help:\"counter\" type:GAUGE metric:<gauge:<value:%d > > ", cntr.Count())
 	assert.Equal(t, expected, serialized, "metrics differ")
 }
 
 func TestPrometheusCounterGetUpdatedWithCustomConverter(t *testing.T) {
 	prometheusRegistry := prometheus.NewRegistry()
+	ticks := make(chan time.Time)
 	metricsRegistry := metrics.NewRegistry()
 	converter := func(_ string, i interface{}) (float64, error) { return 12345, nil }
-	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), Converter(converter))
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), fakeTicker(ticks), Converter(converter))
 	cntr := metrics.NewCounter()
 	metricsRegistry.Register("counter", cntr)
 	cntr.Inc(2)
-	go pClient.UpdatePrometheusMetrics()
 	cntr.Inc(13)
-	time.Sleep(5 * time.Second)
+	flushOnTick(pClient, ticks)
 	metrics, _ := prometheusRegistry.Gather()
 	serialized := fmt.Sprint(metrics[0])
-	expected := fmt.Sprintf("name:\"test_subsys_counter\" help:\"counter\" type:GAUGE metric:<gauge:<value:%d > > ", 12345)
+	expected := fmt.Sprintf("name:\"test_subsys_counter\" help:\"counter\" type:COUNTER metric:<counter:<value:%d > > ", 12345)
 	assert.Equal(t, expected, serialized, "metrics differ")
 }
 
+func TestSetConverter(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+	gauge := metrics.NewGauge()
+	metricsRegistry.Register("gauge", gauge)
+	gauge.Update(3)
+	families, _ := pClient.FlushAndGather()
+	assert.Equal(t, 3.0, families[0].GetMetric()[0].GetGauge().GetValue())
+
+	pClient.SetConverter(func(name string, i interface{}) (float64, error) {
+		value, err := DefaultMetricConverter(name, i)
+		return value * 2, err
+	})
+	families, _ = pClient.FlushAndGather()
+	assert.Equal(t, 6.0, families[0].GetMetric()[0].GetGauge().GetValue(), "the next flush should use the new converter")
+}
+
+func TestConverterFor(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	timers := func(string, interface{}) (float64, error) { return 7, nil }
+	gauges := func(string, interface{}) (float64, error) { return 8, nil }
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		ConverterFor(reflect.TypeOf((*metrics.Timer)(nil)).Elem(), timers),
+		ConverterFor(reflect.TypeOf(&metrics.StandardGauge{}), gauges))
+	cntr := metrics.NewCounter()
+	cntr.Inc(3)
+	metricsRegistry.Register("counter", cntr)
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	metricsRegistry.Register("timer", metrics.NewTimer())
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Equal(t, 3.0, families[0].GetMetric()[0].GetCounter().GetValue(), "other types should use the default converter")
+	assert.Equal(t, 8.0, families[1].GetMetric()[0].GetGauge().GetValue(), "concrete types should match")
+	assert.Equal(t, 7.0, families[2].GetMetric()[0].GetGauge().GetValue(), "implementations of interface types should match")
+
+	_, err = NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, ConverterFor(nil, timers))
+	assert.Error(t, err)
+}
+
+func TestValueTransform(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var seen []float64
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), ValueTransform(func(name string, v float64) float64 {
+		seen = append(seen, v)
+		if name == "latency_ms" {
+			return v / 1000
+		}
+		return v
+	}))
+	latency := metrics.NewGauge()
+	size := metrics.NewGauge()
+	metricsRegistry.Register("latency_ms", latency)
+	metricsRegistry.Register("size", size)
+	latency.Update(250)
+	size.Update(3)
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Equal(t, 0.25, families[0].GetMetric()[0].GetGauge().GetValue())
+	assert.Equal(t, 3.0, families[1].GetMetric()[0].GetGauge().GetValue())
+	assert.ElementsMatch(t, []float64{250, 3}, seen, "the transform should see the converted values")
+}
+
 func TestPrometheusLowercaseNormalizer(t *testing.T) {
 	prometheusRegistry := prometheus.NewRegistry()
+	ticks := make(chan time.Time)
 	metricsRegistry := metrics.NewRegistry()
-	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), KeyNormalizer(LowerCaseKeyNormalizer))
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), fakeTicker(ticks), KeyNormalizer(LowerCaseKeyNormalizer))
 	cntr := metrics.NewCounter()
 	metricsRegistry.Register("Counter", cntr)
 	cntr.Inc(2)
-	go pClient.UpdatePrometheusMetrics()
 	cntr.Inc(13)
-	time.Sleep(5 * time.Second)
+	flushOnTick(pClient, ticks)
 	metrics, _ := prometheusRegistry.Gather()
 	serialized := fmt.Sprint(metrics[0])
-	expected := fmt.Sprintf("name:\"test_subsys_counter\" help:\"Counter\" type:GAUGE metric:<gauge:<value:%d > > ", cntr.Count())
+	expected := fmt.Sprintf("name:\"test_subsys_counter\" help:\"Counter\" type:COUNTER metric:<counter:<value:%d > > ", cntr.Count())
 	assert.Equal(t, expected, serialized, "metrics differ")
 }
 
 func TestPrometheusGaugeGetUpdated(t *testing.T) {
 	prometheusRegistry := prometheus.NewRegistry()
+	ticks := make(chan time.Time)
 	metricsRegistry := metrics.NewRegistry()
-	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), fakeTicker(ticks))
 	gm := metrics.NewGauge()
 	metricsRegistry.Register("gauge", gm)
 	gm.Update(2)
-	go pClient.UpdatePrometheusMetrics()
 	gm.Update(13)
-	time.Sleep(5 * time.Second)
+	flushOnTick(pClient, ticks)
 	metrics, _ := prometheusRegistry.Gather()
 	assert.Equal(t, 1, len(metrics), "prometheus was unable to register the metric")
 	serialized := fmt.Sprint(metrics[0])
@@ -117,17 +256,1563 @@ func TestPrometheusGaugeGetUpdated(t *testing.T) {
 
 func TestPrometheusMeterGetUpdated(t *testing.T) {
 	prometheusRegistry := prometheus.NewRegistry()
+	ticks := make(chan time.Time)
 	metricsRegistry := metrics.NewRegistry()
-	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), fakeTicker(ticks))
 	gm := metrics.NewMeter()
 	metricsRegistry.Register("meter", gm)
 	gm.Mark(2)
-	go pClient.UpdatePrometheusMetrics()
 	gm.Mark(13)
-	time.Sleep(5 * time.Second)
+	flushOnTick(pClient, ticks)
 	metrics, _ := prometheusRegistry.Gather()
 	assert.Equal(t, 1, len(metrics), "prometheus was unable to register the metric")
 	serialized := fmt.Sprint(metrics[0])
 	expected := fmt.Sprintf("name:\"test_subsys_meter\" help:\"meter\" type:GAUGE metric:<gauge:<value:%g > > ", gm.Rate1())
 	assert.Equal(t, expected, serialized, "metrics differ")
 }
+
+func TestExportChangedSince(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+	active := metrics.NewCounter()
+	dormant := metrics.NewCounter()
+	metricsRegistry.Register("active", active)
+	metricsRegistry.Register("dormant", dormant)
+	active.Inc(1)
+	dormant.Inc(1)
+	pClient.UpdatePrometheusMetricsOnce()
+	since := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	active.Inc(1)
+	pClient.UpdatePrometheusMetricsOnce()
+	assert.Equal(t, []string{"active"}, pClient.ExportChangedSince(since), "only the changed metric should be reported")
+}
+
+func TestExportChangedSinceLabeledSeries(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "", "", prometheusRegistry, FlushRate(1*time.Second), TenantSegment(1), RemoveStaleMetrics(true))
+	acme := metrics.NewGauge()
+	globex := metrics.NewGauge()
+	acme.Update(1)
+	globex.Update(2)
+	metricsRegistry.Register("svc.acme.requests", acme)
+	metricsRegistry.Register("svc.globex.requests", globex)
+	pClient.UpdatePrometheusMetricsOnce()
+	since := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	pClient.UpdatePrometheusMetricsOnce()
+	assert.Empty(t, pClient.ExportChangedSince(since), "series sharing a name should not overwrite each other's value")
+
+	globex.Update(3)
+	pClient.UpdatePrometheusMetricsOnce()
+	assert.Equal(t, []string{"svc.requests"}, pClient.ExportChangedSince(since))
+
+	metricsRegistry.Unregister("svc.globex.requests")
+	pClient.UpdatePrometheusMetricsOnce()
+	assert.Len(t, pClient.changes, 1, "removed series should no longer be tracked")
+}
+
+func TestExportedValues(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+	gauge := metrics.NewGauge()
+	cntr := metrics.NewCounter()
+	metricsRegistry.Register("gauge", gauge)
+	metricsRegistry.Register("counter", cntr)
+	gauge.Update(4)
+	cntr.Inc(2)
+	assert.Empty(t, pClient.ExportedValues())
+
+	pClient.UpdatePrometheusMetricsOnce()
+	assert.Equal(t, map[string]float64{"test_subsys_gauge": 4, "test_subsys_counter": 2}, pClient.ExportedValues())
+}
+
+func TestSecondsSinceUpdate(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), SecondsSinceUpdate(true))
+	gauge := metrics.NewGauge()
+	metricsRegistry.Register("gauge", gauge)
+	gauge.Update(1)
+	cntr := metrics.NewCounter()
+	metricsRegistry.Register("counter", cntr)
+	cntr.Inc(1)
+
+	sinceUpdate := func(name string) float64 {
+		families, _ := pClient.FlushAndGather()
+		for _, mf := range families {
+			if mf.GetName() == name {
+				return mf.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		t.Fatalf("no %s gauge exported", name)
+		return 0
+	}
+	for _, name := range []string{"test_subsys_gauge_seconds_since_update", "test_subsys_counter_seconds_since_update"} {
+		first := sinceUpdate(name)
+		time.Sleep(10 * time.Millisecond)
+		assert.True(t, sinceUpdate(name) > first, "the time since the last update of %s should grow while the value is unchanged", name)
+	}
+}
+
+func TestSecondsSinceUpdateLabeledSeries(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "", "", prometheusRegistry, FlushRate(1*time.Second), TenantSegment(1), SecondsSinceUpdate(true))
+	acme := metrics.NewGauge()
+	globex := metrics.NewGauge()
+	acme.Update(1)
+	globex.Update(2)
+	metricsRegistry.Register("svc.acme.requests", acme)
+	metricsRegistry.Register("svc.globex.requests", globex)
+
+	sinceUpdate := func() []float64 {
+		families, _ := pClient.FlushAndGather()
+		var values []float64
+		for _, mf := range families {
+			if mf.GetName() == "svc_requests_seconds_since_update" {
+				for _, m := range mf.GetMetric() {
+					values = append(values, m.GetGauge().GetValue())
+				}
+			}
+		}
+		return values
+	}
+	first := sinceUpdate()
+	time.Sleep(10 * time.Millisecond)
+	second := sinceUpdate()
+	assert.Len(t, second, 2)
+	for i := range second {
+		assert.True(t, second[i] > first[i], "the time since the last update of every static series should grow")
+	}
+}
+
+func TestTicker(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	ticks := make(chan time.Time)
+	intervals := make(chan time.Duration, 1)
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(3*time.Second), Ticker(func(d time.Duration) <-chan time.Time {
+		select {
+		case intervals <- d:
+		default:
+		}
+		return ticks
+	}))
+	gauge := metrics.NewGauge()
+	metricsRegistry.Register("gauge", gauge)
+	gauge.Update(4)
+
+	flushOnTick(pClient, ticks)
+	assert.Equal(t, 3*time.Second, <-intervals, "the ticker should be asked for the flush interval")
+	families, _ := prometheusRegistry.Gather()
+	assert.Len(t, families, 1, "a tick should flush the registry")
+	assert.Equal(t, 4.0, families[0].GetMetric()[0].GetGauge().GetValue())
+}
+
+func TestStartupDelayAndJitter(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	ticks := make(chan time.Time)
+	waits := make(chan time.Duration, 3)
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(time.Minute),
+		StartupDelay(time.Second), FlushJitter(time.Second), Ticker(func(d time.Duration) <-chan time.Time {
+			waits <- d
+			return ticks
+		}))
+
+	done := make(chan struct{})
+	go func() {
+		pClient.UpdatePrometheusMetrics()
+		close(done)
+	}()
+	ticks <- time.Now()
+	ticks <- time.Now()
+	pClient.Stop()
+	<-done
+	first, second := <-waits, <-waits
+	assert.True(t, first >= time.Second && first < 2*time.Second, "the first flush should wait the startup delay plus jitter, waited %s", first)
+	assert.True(t, second >= time.Minute && second < time.Minute+time.Second, "later flushes should wait the interval plus jitter, waited %s", second)
+
+	_, err := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushJitter(-time.Second))
+	assert.Error(t, err)
+}
+
+func TestSetFlushInterval(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	ticks := make(chan time.Time)
+	waits := make(chan time.Duration, 3)
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(time.Minute), Ticker(func(d time.Duration) <-chan time.Time {
+		waits <- d
+		return ticks
+	}))
+	metricsRegistry.Register("counter", metrics.NewCounter())
+
+	done := make(chan struct{})
+	go func() {
+		pClient.UpdatePrometheusMetrics()
+		close(done)
+	}()
+	assert.Equal(t, time.Minute, <-waits)
+	pClient.SetFlushInterval(5 * time.Second)
+	assert.Equal(t, 5*time.Second, <-waits, "the loop should wait the new interval right away")
+	ticks <- time.Now()
+	assert.Equal(t, 5*time.Second, <-waits)
+	pClient.Stop()
+	<-done
+	families, _ := prometheusRegistry.Gather()
+	assert.Len(t, families, 1, "the tick after the reset should flush")
+}
+
+func TestFlushOnStart(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(time.Hour),
+		fakeTicker(make(chan time.Time)), FlushOnStart(true))
+	metricsRegistry.Register("counter", metrics.NewCounter())
+
+	done := make(chan struct{})
+	go func() {
+		pClient.UpdatePrometheusMetrics()
+		close(done)
+	}()
+	pClient.Stop()
+	<-done
+	families, _ := prometheusRegistry.Gather()
+	assert.Len(t, families, 1, "the registry should be flushed before the first tick")
+}
+
+func TestRunTwice(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	ticks := make(chan time.Time)
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(time.Hour), fakeTicker(ticks))
+
+	done := make(chan error)
+	go func() { done <- pClient.Run(context.Background()) }()
+	ticks <- time.Now()
+	assert.Equal(t, ErrAlreadyRunning, pClient.Run(context.Background()), "a second flush loop should not start")
+	pClient.UpdatePrometheusMetrics()
+	pClient.Stop()
+	assert.NoError(t, <-done)
+}
+
+func TestFlushIntervalFunc(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var calls int32
+	ticks := make(chan time.Time)
+	intervals := make(chan time.Duration, 3)
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(time.Hour),
+		FlushIntervalFunc(func() time.Duration {
+			return time.Duration(atomic.AddInt32(&calls, 1)) * time.Second
+		}),
+		Ticker(func(d time.Duration) <-chan time.Time {
+			intervals <- d
+			return ticks
+		}))
+	metricsRegistry.Register("counter", metrics.NewCounter())
+
+	done := make(chan struct{})
+	go func() {
+		pClient.UpdatePrometheusMetrics()
+		close(done)
+	}()
+	ticks <- time.Now()
+	ticks <- time.Now()
+	pClient.Stop()
+	<-done
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls), "the interval should be looked up before each flush")
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 3 * time.Second},
+		[]time.Duration{<-intervals, <-intervals, <-intervals}, "the looked up intervals should be waited for")
+	families, _ := prometheusRegistry.Gather()
+	assert.Len(t, families, 1, "the registry should have been flushed on every tick")
+}
+
+func TestTimerFamilies(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), TimerFamilies(true), Percentiles(0.5, 0.99))
+	timer := metrics.NewTimer()
+	metricsRegistry.Register("timer", timer)
+	timer.Update(2 * time.Second)
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Len(t, families, 1, "the timer should be exported as a single family")
+	assert.Equal(t, "test_subsys_timer", families[0].GetName())
+
+	series := make(map[string]float64)
+	for _, m := range families[0].GetMetric() {
+		labels := make(map[string]string)
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		series[labels["kind"]+"/"+labels["quantile"]] = m.GetGauge().GetValue()
+	}
+	assert.Len(t, series, 3)
+	assert.Contains(t, series, "rate/")
+	assert.Equal(t, 2.0, series["latency_seconds/0.5"])
+	assert.Equal(t, 2.0, series["latency_seconds/0.99"])
+}
+
+func TestUnitCheck(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var warnings []string
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		UnitCheck(map[string]float64{"_seconds": 1e6}),
+		Logger(func(format string, args ...interface{}) { warnings = append(warnings, fmt.Sprintf(format, args...)) }))
+	suspicious := metrics.NewGauge()
+	plausible := metrics.NewGauge()
+	metricsRegistry.Register("request.duration_seconds", suspicious)
+	metricsRegistry.Register("uptime_seconds", plausible)
+	suspicious.Update(int64(2 * time.Second))
+	plausible.Update(3600)
+	pClient.UpdatePrometheusMetricsOnce()
+
+	assert.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], "test_subsys_request_duration_seconds")
+}
+
+func TestLoggerReportsFailuresAndRemovals(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var warnings []string
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), RemoveStaleMetrics(true),
+		Logger(func(format string, args ...interface{}) { warnings = append(warnings, fmt.Sprintf(format, args...)) }))
+	metricsRegistry.Register("unknown", metrics.NewHealthcheck(func(metrics.Healthcheck) {}))
+	metricsRegistry.Register("gone", metrics.NewGauge())
+	pClient.UpdatePrometheusMetricsOnce()
+	assert.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], "metric 'unknown' has unknown type")
+
+	metricsRegistry.Unregister("unknown")
+	metricsRegistry.Unregister("gone")
+	pClient.UpdatePrometheusMetricsOnce()
+	assert.ElementsMatch(t, []string{"removing stale metric 'test_subsys_gone'", "removing stale metric 'test_subsys_unknown'"}, warnings[1:])
+}
+
+func TestWithLogger(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var buf bytes.Buffer
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		WithLogger(log.New(&buf, "", 0)))
+	metricsRegistry.Register("unknown", metrics.NewHealthcheck(func(metrics.Healthcheck) {}))
+	pClient.UpdatePrometheusMetricsOnce()
+	assert.Contains(t, buf.String(), "metric 'unknown' has unknown type")
+
+	_, err := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, WithLogger(nil))
+	assert.Error(t, err)
+}
+
+func TestLabelConflictPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy LabelConflict
+		tenant string
+		err    bool
+	}{
+		{ConstWins, "default", false},
+		{ExtractedWins, "acme", false},
+		{ConflictError, "", true},
+	} {
+		prometheusRegistry := prometheus.NewRegistry()
+		metricsRegistry := metrics.NewRegistry()
+		pClient, _ := NewPrometheusProvider(metricsRegistry, "", "", prometheusRegistry, FlushRate(1*time.Second),
+			TenantSegment(1), SourceRegistryLabel("tenant"), LabelConflictPolicy(tc.policy))
+		metricsRegistry.Register("svc.acme.requests", metrics.NewCounter())
+
+		err := pClient.ExportMetric("svc.acme.requests", metricsRegistry.Get("svc.acme.requests"))
+		families, _ := prometheusRegistry.Gather()
+		if tc.err {
+			assert.Error(t, err, "policy %d", tc.policy)
+			assert.Empty(t, families, "policy %d", tc.policy)
+			continue
+		}
+		assert.NoError(t, err, "policy %d", tc.policy)
+		assert.Equal(t, "svc_requests", families[0].GetName())
+		assert.Equal(t, tc.tenant, families[0].GetMetric()[0].GetLabel()[0].GetValue(), "policy %d", tc.policy)
+	}
+}
+
+func TestExtractedWinsDistinctValues(t *testing.T) {
+	for _, label := range []optSetter{SourceRegistryLabel("tenant"), ConstLabels(prometheus.Labels{"tenant": "default"})} {
+		prometheusRegistry := prometheus.NewRegistry()
+		metricsRegistry := metrics.NewRegistry()
+		pClient, _ := NewPrometheusProvider(metricsRegistry, "", "", prometheusRegistry, FlushRate(1*time.Second),
+			TenantSegment(1), label, LabelConflictPolicy(ExtractedWins))
+		acme := metrics.NewGauge()
+		globex := metrics.NewGauge()
+		acme.Update(1)
+		globex.Update(2)
+		metricsRegistry.Register("svc.acme.requests", acme)
+		metricsRegistry.Register("svc.globex.requests", globex)
+
+		families, err := pClient.FlushAndGather()
+		assert.NoError(t, err, "distinct extracted values should not collide")
+		assert.Equal(t, 1, len(families))
+		values := map[string]float64{}
+		for _, m := range families[0].GetMetric() {
+			values[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+		}
+		assert.Equal(t, map[string]float64{"acme": 1, "globex": 2}, values, "every extracted value should be exported as its own series")
+	}
+}
+
+func TestRateWarmup(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), RateWarmup(50*time.Millisecond))
+	metricsRegistry.Register("meter", metrics.NewMeter())
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+
+	names := func() []string {
+		families, _ := pClient.FlushAndGather()
+		var names []string
+		for _, mf := range families {
+			names = append(names, mf.GetName())
+		}
+		return names
+	}
+	assert.Equal(t, []string{"test_subsys_gauge"}, names(), "rates should not be exported during the warmup")
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, []string{"test_subsys_gauge", "test_subsys_meter"}, names(), "rates should be exported after the warmup")
+}
+
+func TestMaxLabels(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var warnings []string
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "", "", prometheusRegistry, FlushRate(1*time.Second),
+		TenantSegment(1), SourceRegistryLabel("registry"), MaxLabels(1),
+		Logger(func(format string, args ...interface{}) { warnings = append(warnings, fmt.Sprintf(format, args...)) }))
+	counter := metrics.NewCounter()
+
+	err := pClient.ExportMetric("svc.acme.requests", counter)
+	assert.Error(t, err, "a metric with too many labels should be rejected")
+	assert.Len(t, warnings, 1, "the rejection should be logged")
+	families, _ := prometheusRegistry.Gather()
+	assert.Empty(t, families)
+
+	FoldExcessLabels(true)(pClient)
+	assert.NoError(t, pClient.ExportMetric("svc.acme.requests", counter))
+	families, _ = prometheusRegistry.Gather()
+	assert.Equal(t, "svc_acme_requests", families[0].GetName(), "the excess label should be folded back into the name")
+	assert.Len(t, families[0].GetMetric()[0].GetLabel(), 1)
+}
+
+func TestSampleRate(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), SampleRate(0.25))
+	for i := 0; i < 1000; i++ {
+		metricsRegistry.Register(fmt.Sprintf("gauge.%d", i), metrics.NewGauge())
+	}
+
+	names := func() []string {
+		families, _ := pClient.FlushAndGather()
+		var names []string
+		for _, mf := range families {
+			names = append(names, mf.GetName())
+		}
+		return names
+	}
+	first := names()
+	assert.InDelta(t, 250, len(first), 50, "about a quarter of the metrics should be exported")
+	assert.Equal(t, first, names(), "the same metrics should be exported by every flush")
+}
+
+func TestStop(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	ticks := make(chan time.Time)
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(time.Millisecond), fakeTicker(ticks))
+	metricsRegistry.Register("counter", metrics.NewCounter())
+
+	done := make(chan struct{})
+	go func() {
+		pClient.UpdatePrometheusMetrics()
+		close(done)
+	}()
+	ticks <- time.Now()
+	pClient.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the flush loop should end after Stop")
+	}
+	assert.NotPanics(t, pClient.Stop, "stopping twice should have no effect")
+}
+
+func TestClose(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), fakeTicker(make(chan time.Time)),
+		SelfMetrics(true), GaugeFuncs(map[string]func() float64{"uptime": func() float64 { return 1 }}), Percentiles(0.5))
+	metricsRegistry.Register("counter", metrics.NewCounter())
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	h := metrics.NewHistogram(metrics.NewUniformSample(10))
+	h.Update(1)
+	metricsRegistry.Register("histogram", h)
+	other := prometheus.NewGauge(prometheus.GaugeOpts{Name: "other", Help: "other"})
+	prometheusRegistry.MustRegister(other)
+	pClient.UpdatePrometheusMetricsOnce()
+
+	done := make(chan struct{})
+	go func() {
+		pClient.UpdatePrometheusMetrics()
+		close(done)
+	}()
+	assert.NoError(t, pClient.Close())
+	<-done
+	families, err := prometheusRegistry.Gather()
+	assert.NoError(t, err)
+	assert.Len(t, families, 1, "only collectors of others should be left")
+	assert.Equal(t, "other", families[0].GetName())
+}
+
+func TestCloseKeepsAdoptedGauges(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), RemoveStaleMetrics(true))
+	existing := prometheus.NewGauge(prometheus.GaugeOpts{Namespace: "test", Subsystem: "subsys", Name: "gauge", Help: "gauge"})
+	prometheusRegistry.MustRegister(existing)
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	metricsRegistry.Register("created", metrics.NewGauge())
+	assert.NoError(t, pClient.UpdatePrometheusMetricsOnce())
+
+	assert.NoError(t, pClient.Close())
+	families, _ := prometheusRegistry.Gather()
+	assert.Len(t, families, 1, "only the gauges the provider created should be unregistered")
+	assert.Equal(t, "test_subsys_gauge", families[0].GetName())
+
+	pClient, _ = NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), RemoveStaleMetrics(true))
+	assert.NoError(t, pClient.UpdatePrometheusMetricsOnce())
+	metricsRegistry.Unregister("gauge")
+	assert.NoError(t, pClient.UpdatePrometheusMetricsOnce())
+	families, _ = prometheusRegistry.Gather()
+	assert.Len(t, families, 2, "a stale gauge taken over should stay registered")
+}
+
+func TestRun(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	ticks := make(chan time.Time)
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(time.Millisecond), fakeTicker(ticks))
+	metricsRegistry.Register("counter", metrics.NewCounter())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() { errs <- pClient.Run(ctx) }()
+	ticks <- time.Now()
+	ticks <- time.Now()
+	cancel()
+	select {
+	case err := <-errs:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("Run should return once its context is cancelled")
+	}
+	families, _ := prometheusRegistry.Gather()
+	assert.Len(t, families, 1, "the registry should have been flushed while running")
+}
+
+func TestConcurrentFlushes(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(time.Millisecond))
+	for i := 0; i < 10; i++ {
+		metricsRegistry.Register(fmt.Sprintf("gauge_%d", i), metrics.NewGauge())
+	}
+	go pClient.UpdatePrometheusMetrics()
+	defer pClient.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				assert.NoError(t, pClient.UpdatePrometheusMetricsOnce())
+			}
+		}()
+	}
+	wg.Wait()
+	families, _ := prometheusRegistry.Gather()
+	assert.Len(t, families, 10)
+}
+
+func TestConstLabels(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, err := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		ConstLabels(prometheus.Labels{"region": "us-east"}))
+	assert.NoError(t, err)
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	families, _ := pClient.FlushAndGather()
+	labels := families[0].GetMetric()[0].GetLabel()
+	assert.Len(t, labels, 1)
+	assert.Equal(t, "region", labels[0].GetName())
+	assert.Equal(t, "us-east", labels[0].GetValue())
+
+	_, err = NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, ConstLabels(prometheus.Labels{"bad-name": "x"}))
+	assert.Error(t, err, "invalid label names should be rejected")
+}
+
+func TestSharedRegistry(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	first, _ := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+	second, _ := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+	gauge := metrics.NewGauge()
+	gauge.Update(3)
+
+	assert.NoError(t, first.ExportMetric("gauge", gauge))
+	assert.NoError(t, second.ExportMetric("gauge", gauge), "an equal gauge should reuse the registered one")
+	families, _ := prometheusRegistry.Gather()
+	assert.Equal(t, 3.0, families[0].GetMetric()[0].GetGauge().GetValue())
+
+	assert.NoError(t, first.ExportMetric("requests", metrics.NewCounter()))
+	assert.NotPanics(t, func() {
+		assert.Error(t, second.ExportMetric("requests", metrics.NewGauge()), "a gauge colliding with a counter should fail")
+	})
+}
+
+func TestMetricFilter(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), RemoveStaleMetrics(true),
+		MetricFilter(RegexpFilter(regexp.MustCompile(`^http\.`), regexp.MustCompile(`\.debug$`))))
+	metricsRegistry.Register("http.requests", metrics.NewGauge())
+	metricsRegistry.Register("http.requests.debug", metrics.NewGauge())
+	metricsRegistry.Register("db.queries", metrics.NewGauge())
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Len(t, families, 1)
+	assert.Equal(t, "test_subsys_http_requests", families[0].GetName())
+
+	MetricFilter(func(string) bool { return false })(pClient)
+	families, _ = pClient.FlushAndGather()
+	assert.Empty(t, families, "series of metrics filtered out should be removed")
+}
+
+func TestFlushNow(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(time.Millisecond))
+	gauge := metrics.NewGauge()
+	metricsRegistry.Register("gauge", gauge)
+	go pClient.UpdatePrometheusMetrics()
+	defer pClient.Stop()
+
+	for i := int64(1); i <= 20; i++ {
+		gauge.Update(i)
+		assert.NoError(t, pClient.FlushNow())
+		families, _ := prometheusRegistry.Gather()
+		assert.Equal(t, float64(i), families[0].GetMetric()[0].GetGauge().GetValue(), "the flush should be done when FlushNow returns")
+	}
+
+	metricsRegistry.Register("unknown", metrics.NewHealthcheck(func(metrics.Healthcheck) {}))
+	assert.Error(t, pClient.FlushNow())
+}
+
+func TestNonFiniteValues(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	rate := 2.0
+	converter := func(string, interface{}) (float64, error) { return rate, nil }
+	var failed []string
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		Converter(converter), OnError(func(name string, err error) { failed = append(failed, name) }))
+	metricsRegistry.Register("rate", metrics.NewGauge())
+	pClient.UpdatePrometheusMetricsOnce()
+
+	for _, value := range []float64{math.NaN(), math.Inf(1)} {
+		rate = value
+		families, err := pClient.FlushAndGather()
+		assert.True(t, errors.Is(err, ErrNonFiniteValue))
+		assert.Equal(t, 2.0, families[0].GetMetric()[0].GetGauge().GetValue(), "the last finite value should be kept")
+	}
+	assert.Equal(t, []string{"rate", "rate"}, failed)
+
+	PropagateNonFinite(true)(pClient)
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.True(t, math.IsInf(families[0].GetMetric()[0].GetGauge().GetValue(), 1), "non finite values should be exported if enabled")
+}
+
+func TestFunctionalGauges(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+	metricsRegistry.Register("goroutines", metrics.NewFunctionalGauge(func() int64 { return 42 }))
+	metricsRegistry.Register("load", metrics.NewFunctionalGaugeFloat64(func() float64 { return 0.123456789 }))
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Equal(t, "test_subsys_goroutines", families[0].GetName())
+	assert.Equal(t, 42.0, families[0].GetMetric()[0].GetGauge().GetValue())
+	assert.Equal(t, "test_subsys_load", families[1].GetName())
+	assert.Equal(t, 0.123456789, families[1].GetMetric()[0].GetGauge().GetValue(), "float gauges should keep their precision")
+
+	prometheusRegistry = prometheus.NewRegistry()
+	pClient, _ = NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), SkipFunctionalGauges(true))
+	families, _ = pClient.FlushAndGather()
+	assert.Empty(t, families, "functional gauges should be skipped if disabled")
+}
+
+func TestIsolatedRegistry(t *testing.T) {
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "isolated", "subsys", prometheus.DefaultRegisterer, FlushRate(1*time.Second), Isolated(true))
+	metricsRegistry.Register("counter", metrics.NewCounter())
+	pClient.UpdatePrometheusMetricsOnce()
+
+	defaultFamilies, _ := prometheus.DefaultGatherer.Gather()
+	for _, mf := range defaultFamilies {
+		assert.NotEqual(t, "isolated_subsys_counter", mf.GetName(), "isolated metric leaked into the default registry")
+	}
+	families, err := pClient.Gatherer().Gather()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(families), "isolated metric should be gathered from the provider")
+	assert.Equal(t, "isolated_subsys_counter", families[0].GetName())
+}
+
+func TestInstanceLabel(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, err := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), InstanceLabel(true))
+	assert.NoError(t, err)
+	metricsRegistry.Register("counter", metrics.NewCounter())
+	pClient.UpdatePrometheusMetricsOnce()
+	families, _ := prometheusRegistry.Gather()
+	assert.Equal(t, 1, len(families), "prometheus was unable to register the metric")
+	labels := families[0].GetMetric()[0].GetLabel()
+	assert.Equal(t, 1, len(labels), "expected a single instance label")
+	assert.Equal(t, "instance", labels[0].GetName())
+	assert.NotEmpty(t, labels[0].GetValue(), "instance label should not be empty")
+}
+
+func TestTypeChangeThreshold(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		HistogramBuckets(map[string][]float64{}), TypeChangeThreshold(2))
+	typeOf := func() string {
+		families, _ := prometheusRegistry.Gather()
+		assert.Equal(t, 1, len(families), "expected exactly one exported series")
+		return families[0].GetType().String()
+	}
+
+	metricsRegistry.Register("flappy", metrics.NewGauge())
+	pClient.UpdatePrometheusMetricsOnce()
+	assert.Equal(t, "GAUGE", typeOf())
+
+	// a single flush with a different type does not re-register the series
+	metricsRegistry.Unregister("flappy")
+	metricsRegistry.Register("flappy", metrics.NewHistogram(metrics.NewUniformSample(10)))
+	pClient.UpdatePrometheusMetricsOnce()
+	assert.Equal(t, "GAUGE", typeOf())
+
+	metricsRegistry.Unregister("flappy")
+	metricsRegistry.Register("flappy", metrics.NewGauge())
+	pClient.UpdatePrometheusMetricsOnce()
+	assert.Equal(t, "GAUGE", typeOf())
+
+	// once the new type is stable the series is re-registered
+	metricsRegistry.Unregister("flappy")
+	metricsRegistry.Register("flappy", metrics.NewHistogram(metrics.NewUniformSample(10)))
+	pClient.UpdatePrometheusMetricsOnce()
+	assert.Equal(t, "GAUGE", typeOf())
+	pClient.UpdatePrometheusMetricsOnce()
+	assert.Equal(t, "HISTOGRAM", typeOf())
+}
+
+func TestRegistryModifiedDuringFlush(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+
+	const total = 200
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < total; i++ {
+			metricsRegistry.Register(fmt.Sprintf("counter_%d", i), metrics.NewCounter())
+		}
+	}()
+	for flushing := true; flushing; {
+		select {
+		case <-done:
+			flushing = false
+		default:
+			pClient.UpdatePrometheusMetricsOnce()
+		}
+	}
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, err := prometheusRegistry.Gather()
+	assert.NoError(t, err)
+	assert.Equal(t, total, len(families), "every registered metric should be exported exactly once")
+}
+
+func TestMaxNameLength(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), MaxNameLength(40))
+	metricsRegistry.Register("some.very.long.metric.name.that.keeps.going", metrics.NewCounter())
+	metricsRegistry.Register("short", metrics.NewCounter())
+	pClient.UpdatePrometheusMetricsOnce()
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	assert.Equal(t, 2, len(families), "prometheus was unable to register the metrics")
+	assert.Equal(t, "test_subsys_short", families[0].GetName())
+	assert.Equal(t, "test_subsys_some_very_long_metr_83a149c0", families[1].GetName())
+	assert.Equal(t, 40, len(families[1].GetName()))
+}
+
+func TestFlushTimeout(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	slow := func(name string, i interface{}) (float64, error) {
+		time.Sleep(20 * time.Millisecond)
+		return DefaultMetricConverter(name, i)
+	}
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		Converter(slow), FlushTimeout(30*time.Millisecond))
+	for i := 0; i < 5; i++ {
+		metricsRegistry.Register(fmt.Sprintf("counter_%d", i), metrics.NewCounter())
+	}
+	err := pClient.UpdatePrometheusMetricsOnce()
+	timeout, ok := err.(*FlushTimeoutError)
+	if assert.True(t, ok, "expected a flush timeout error, got %v", err) {
+		assert.Equal(t, 5, timeout.Total)
+		assert.True(t, timeout.Processed > 0 && timeout.Processed < 5, "unexpected number of processed metrics: %d", timeout.Processed)
+		families, _ := prometheusRegistry.Gather()
+		assert.Equal(t, timeout.Processed, len(families), "processed metrics should stay exported")
+	}
+}
+
+func TestFlushTimeoutReportedByLoop(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	slow := func(name string, i interface{}) (float64, error) {
+		time.Sleep(20 * time.Millisecond)
+		return DefaultMetricConverter(name, i)
+	}
+	var errs []error
+	ticks := make(chan time.Time)
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), fakeTicker(ticks),
+		Converter(slow), FlushTimeout(30*time.Millisecond), OnError(func(name string, err error) {
+			assert.Equal(t, "", name, "an aborted flush should be reported without a metric name")
+			errs = append(errs, err)
+		}))
+	for i := 0; i < 5; i++ {
+		metricsRegistry.Register(fmt.Sprintf("counter_%d", i), metrics.NewCounter())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		pClient.UpdatePrometheusMetrics()
+		close(done)
+	}()
+	ticks <- time.Now()
+	ticks <- time.Now()
+	pClient.Stop()
+	<-done
+	if assert.NotEmpty(t, errs, "the aborted flush should be reported") {
+		_, ok := errs[0].(*FlushTimeoutError)
+		assert.True(t, ok, "expected a flush timeout error, got %v", errs[0])
+	}
+}
+
+func TestFlushCancelled(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+	metricsRegistry.Register("counter", metrics.NewCounter())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, pClient.updateOnce(ctx), "a flush stopped by its context is no timeout")
+}
+
+func TestTypeLabel(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), TypeLabel(true))
+	metricsRegistry.Register("requests", metrics.NewCounter())
+	metricsRegistry.Register("latency", metrics.NewTimer())
+	metricsRegistry.Register("load", metrics.NewGaugeFloat64())
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	types := map[string]string{}
+	for _, mf := range families {
+		label := mf.GetMetric()[0].GetLabel()[0]
+		assert.Equal(t, "metric_type", label.GetName())
+		types[mf.GetName()] = label.GetValue()
+	}
+	assert.Equal(t, map[string]string{
+		"test_subsys_requests": "counter",
+		"test_subsys_latency":  "timer",
+		"test_subsys_load":     "gauge_float64",
+	}, types)
+
+	prometheusRegistry = prometheus.NewRegistry()
+	pClient, _ = NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), TypeLabelName("kind"))
+	families, _ = pClient.FlushAndGather()
+	assert.Equal(t, "kind", families[0].GetMetric()[0].GetLabel()[0].GetName())
+
+	_, err = NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, TypeLabelName("1kind"))
+	assert.Error(t, err)
+}
+
+func TestSourceRegistryLabel(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	otherRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		RegistryName("web"), SourceRegistry("db", otherRegistry), SourceRegistryLabel("source_registry"))
+	metricsRegistry.Register("requests", metrics.NewCounter())
+	otherRegistry.Register("requests", metrics.NewCounter())
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, err := prometheusRegistry.Gather()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(families), "both metrics should share one family")
+	var sources []string
+	for _, m := range families[0].GetMetric() {
+		for _, l := range m.GetLabel() {
+			if l.GetName() == "source_registry" {
+				sources = append(sources, l.GetValue())
+			}
+		}
+	}
+	assert.Equal(t, []string{"db", "web"}, sources, "each series should name its source registry")
+}
+
+func TestSourceRegistryCollisions(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	otherRegistry := metrics.NewRegistry()
+	var failed []string
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		SourceRegistry("db", otherRegistry), OnError(func(name string, err error) { failed = append(failed, err.Error()) }))
+	web := metrics.NewGauge()
+	db := metrics.NewGauge()
+	web.Update(1)
+	db.Update(2)
+	metricsRegistry.Register("connections", web)
+	otherRegistry.Register("connections", db)
+	metricsRegistry.Register("queue.size", metrics.NewGauge())
+	metricsRegistry.Register("queue_size", metrics.NewGauge())
+
+	families, err := pClient.FlushAndGather()
+	assert.Error(t, err)
+	assert.Equal(t, []string{
+		"metric 'queue_size' of registry 'default' collides with metric 'queue.size' of registry 'default'",
+		"metric 'connections' of registry 'db' collides with metric 'connections' of registry 'default'",
+	}, failed)
+	assert.Len(t, families, 2)
+	assert.Equal(t, 1.0, families[0].GetMetric()[0].GetGauge().GetValue(), "the first metric should keep the series")
+}
+
+func TestFlushAndGather(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+	cntr := metrics.NewCounter()
+	metricsRegistry.Register("counter", cntr)
+	cntr.Inc(2)
+	metrics, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(metrics), "prometheus was unable to register the metric")
+	assert.Equal(t, 2.0, metrics[0].GetMetric()[0].GetCounter().GetValue())
+
+	cntr.Inc(13)
+	metrics, err = pClient.FlushAndGather()
+	assert.NoError(t, err)
+	serialized := fmt.Sprint(metrics[0])
+	expected := fmt.Sprintf("name:\"test_subsys_counter\" help:\"counter\" type:COUNTER metric:<counter:<value:%d > > ", cntr.Count())
+	assert.Equal(t, expected, serialized, "metrics differ")
+}
+
+func TestFlushAndGatherWithoutGatherer(t *testing.T) {
+	pClient, _ := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.WrapRegistererWithPrefix("wrapped_", prometheus.NewRegistry()))
+	_, err := pClient.FlushAndGather()
+	assert.Error(t, err, "a registerer that cannot be gathered should be rejected")
+}
+
+func TestEnumMapping(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		EnumMapping(map[string]map[int64]string{"worker": {0: "idle", 1: "busy", 2: "error"}}))
+	gm := metrics.NewGauge()
+	metricsRegistry.Register("worker", gm)
+	states := func() map[string]float64 {
+		families, err := pClient.FlushAndGather()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(families), "prometheus was unable to register the metric")
+		states := map[string]float64{}
+		for _, m := range families[0].GetMetric() {
+			states[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+		}
+		return states
+	}
+
+	gm.Update(1)
+	assert.Equal(t, map[string]float64{"idle": 0, "busy": 1, "error": 0}, states())
+	gm.Update(0)
+	assert.Equal(t, map[string]float64{"idle": 1, "busy": 0, "error": 0}, states())
+}
+
+func TestConverterChain(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	gaugesOnly := func(name string, i interface{}) (float64, error) {
+		if g, ok := i.(metrics.Gauge); ok {
+			return float64(g.Value()) * 10, nil
+		}
+		return 0, ErrUnknownMetricType
+	}
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		ConverterChain(gaugesOnly, DefaultMetricConverter))
+	gm := metrics.NewGauge()
+	cntr := metrics.NewCounter()
+	metricsRegistry.Register("gauge", gm)
+	metricsRegistry.Register("counter", cntr)
+	metricsRegistry.Register("healthcheck", metrics.NewHealthcheck(func(metrics.Healthcheck) {}))
+	gm.Update(2)
+	cntr.Inc(3)
+
+	families, err := pClient.FlushAndGather()
+	assert.True(t, errors.Is(err, ErrUnknownMetricType), "no converter of the chain knows healthchecks")
+	values := map[string]float64{}
+	for _, mf := range families {
+		values[mf.GetName()], _ = value(mf.GetMetric()[0])
+	}
+	assert.Equal(t, map[string]float64{"test_subsys_counter": 3, "test_subsys_gauge": 20}, values)
+}
+
+func TestFlushError(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+	metricsRegistry.Register("first", metrics.NewHealthcheck(func(metrics.Healthcheck) {}))
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	metricsRegistry.Register("second", metrics.NewHealthcheck(func(metrics.Healthcheck) {}))
+
+	families, err := pClient.FlushAndGather()
+	flushErr, ok := err.(*FlushError)
+	assert.True(t, ok, "expected a FlushError, got %v", err)
+	assert.Len(t, flushErr.Errors, 2)
+	assert.Contains(t, err.Error(), "metric 'first'")
+	assert.Contains(t, err.Error(), "metric 'second'")
+	assert.Len(t, families, 1, "the other metrics should still be exported")
+}
+
+func TestConverterSkipAndRemove(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var verdict error
+	converter := func(name string, i interface{}) (float64, error) {
+		if verdict != nil {
+			return 0, fmt.Errorf("metric '%s': %w", name, verdict)
+		}
+		return DefaultMetricConverter(name, i)
+	}
+	var failed []string
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		Converter(converter), OnError(func(name string, err error) { failed = append(failed, name) }))
+	gauge := metrics.NewGauge()
+	metricsRegistry.Register("gauge", gauge)
+	gauge.Update(3)
+	pClient.UpdatePrometheusMetricsOnce()
+
+	verdict = ErrSkipMetric
+	gauge.Update(4)
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err, "a skipped metric should not fail the flush")
+	assert.Equal(t, 3.0, families[0].GetMetric()[0].GetGauge().GetValue(), "a skipped metric should keep its value")
+
+	verdict = ErrRemoveMetric
+	families, err = pClient.FlushAndGather()
+	assert.NoError(t, err, "a removed metric should not fail the flush")
+	assert.Empty(t, families, "a removed metric should be unregistered")
+
+	verdict = nil
+	families, _ = pClient.FlushAndGather()
+	assert.Equal(t, 4.0, families[0].GetMetric()[0].GetGauge().GetValue(), "a removed metric should be exported again once converted")
+	assert.Empty(t, failed, "skipping and removing should not be reported as errors")
+}
+
+func TestOnError(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var failed []string
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), OnError(func(name string, err error) {
+		assert.Error(t, err)
+		failed = append(failed, name)
+	}))
+	metricsRegistry.Register("unknown", metrics.NewHealthcheck(func(metrics.Healthcheck) {}))
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	prometheusRegistry.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "test_subsys_taken", Help: "taken"}))
+	metricsRegistry.Register("taken", metrics.NewGauge())
+
+	pClient.UpdatePrometheusMetricsOnce()
+	assert.Equal(t, []string{"taken", "unknown"}, failed, "conversion and registration failures should be reported in order")
+}
+
+func TestAdoptRegisteredGauge(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+	existing := prometheus.NewGauge(prometheus.GaugeOpts{Namespace: "test", Subsystem: "subsys", Name: "gauge", Help: "gauge"})
+	prometheusRegistry.MustRegister(existing)
+	gauge := metrics.NewGauge()
+	metricsRegistry.Register("gauge", gauge)
+	gauge.Update(9)
+
+	assert.NoError(t, pClient.UpdatePrometheusMetricsOnce())
+	assert.Equal(t, 9.0, testutil.ToFloat64(existing), "the registered gauge should be updated")
+	assert.Equal(t, existing, pClient.gauges["test_subsys_gauge"], "the registered gauge should be adopted")
+	gauge.Update(10)
+	assert.NoError(t, pClient.UpdatePrometheusMetricsOnce())
+	assert.Equal(t, 10.0, testutil.ToFloat64(existing))
+}
+
+func TestSharedRegistryCounters(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	first := metrics.NewRegistry()
+	second := metrics.NewRegistry()
+	firstClient, _ := NewPrometheusProvider(first, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+	secondClient, _ := NewPrometheusProvider(second, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+	firstCounter := metrics.NewCounter()
+	secondCounter := metrics.NewCounter()
+	first.Register("counter", firstCounter)
+	second.Register("counter", secondCounter)
+	firstCounter.Inc(10)
+	secondCounter.Inc(3)
+
+	assert.NoError(t, firstClient.UpdatePrometheusMetricsOnce())
+	assert.Error(t, secondClient.UpdatePrometheusMetricsOnce(), "a counter registered by another provider should not be taken over")
+	families, _ := prometheusRegistry.Gather()
+	assert.Equal(t, 10.0, families[0].GetMetric()[0].GetCounter().GetValue(), "the totals of both providers should not be added up")
+}
+
+func TestLabelParser(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), LabelParser(CommaLabels))
+	get := metrics.NewGauge()
+	post := metrics.NewGauge()
+	metricsRegistry.Register("http_requests,method=GET,code=200", get)
+	metricsRegistry.Register("http_requests,method=POST,code=200", post)
+	metricsRegistry.Register("queue", metrics.NewGauge())
+	get.Update(3)
+	post.Update(1)
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(families))
+	assert.Equal(t, "test_subsys_http_requests", families[0].GetName())
+	values := map[string]float64{}
+	for _, m := range families[0].GetMetric() {
+		labels := m.GetLabel()
+		assert.Equal(t, "code", labels[0].GetName())
+		assert.Equal(t, "200", labels[0].GetValue())
+		values[labels[1].GetValue()] = m.GetGauge().GetValue()
+	}
+	assert.Equal(t, map[string]float64{"GET": 3, "POST": 1}, values)
+	assert.Equal(t, "test_subsys_queue", families[1].GetName(), "names without labels should be unchanged")
+	assert.Empty(t, families[1].GetMetric()[0].GetLabel())
+}
+
+func TestLabelParserGaugeVecs(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		LabelParser(CommaLabels), RemoveStaleMetrics(true))
+	metricsRegistry.Register("http_requests,method=GET", metrics.NewGauge())
+	metricsRegistry.Register("http_requests,method=POST", metrics.NewGauge())
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Len(t, families[0].GetMetric(), 2)
+	assert.Len(t, pClient.gaugeVecs, 1, "every label combination should share one gauge vec")
+	assert.Empty(t, pClient.gauges)
+
+	metricsRegistry.Unregister("http_requests,method=POST")
+	families, err = pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Len(t, families[0].GetMetric(), 1, "the stale label combination should be deleted")
+	assert.Equal(t, "GET", families[0].GetMetric()[0].GetLabel()[0].GetValue())
+}
+
+func TestMaxSeriesPerMetric(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var errs []error
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		LabelParser(CommaLabels), MaxSeriesPerMetric(2), OnError(func(name string, err error) { errs = append(errs, err) }))
+	alice := metrics.NewGauge()
+	bob := metrics.NewGauge()
+	alice.Update(1)
+	bob.Update(2)
+	assert.NoError(t, pClient.ExportMetric("sessions,user=alice", alice))
+	assert.NoError(t, pClient.ExportMetric("sessions,user=bob", bob))
+	err := pClient.ExportMetric("sessions,user=carol", metrics.NewGauge())
+	assert.True(t, errors.Is(err, ErrCardinalityExceeded), "a third label combination should be rejected")
+	assert.Len(t, errs, 1, "the rejection should be reported")
+	assert.NoError(t, pClient.ExportMetric("queue", metrics.NewGauge()), "other names should have their own limit")
+
+	alice.Update(5)
+	assert.NoError(t, pClient.ExportMetric("sessions,user=alice", alice), "existing series should keep updating")
+	families, _ := prometheusRegistry.Gather()
+	assert.Equal(t, "test_subsys_sessions", families[1].GetName())
+	assert.Len(t, families[1].GetMetric(), 2)
+	assert.Equal(t, 5.0, families[1].GetMetric()[0].GetGauge().GetValue())
+
+	pClient.removeSeenBefore(time.Now())
+	assert.NoError(t, pClient.ExportMetric("sessions,user=carol", metrics.NewGauge()), "removed series should free their slots")
+}
+
+func TestCommaLabels(t *testing.T) {
+	name, labels := CommaLabels("requests,method=GET")
+	assert.Equal(t, "requests", name)
+	assert.Equal(t, prometheus.Labels{"method": "GET"}, labels)
+	name, labels = CommaLabels("requests")
+	assert.Equal(t, "requests", name)
+	assert.Nil(t, labels)
+	name, labels = CommaLabels("requests,GET")
+	assert.Equal(t, "requests,GET", name)
+	assert.Nil(t, labels)
+}
+
+func TestTenantSegment(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "", "", prometheusRegistry, FlushRate(1*time.Second), TenantSegment(1))
+	acme := metrics.NewCounter()
+	initech := metrics.NewCounter()
+	metricsRegistry.Register("svc.acme.requests", acme)
+	metricsRegistry.Register("svc.initech.requests", initech)
+	metricsRegistry.Register("uptime", metrics.NewGauge())
+	acme.Inc(2)
+	initech.Inc(3)
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(families))
+	assert.Equal(t, "svc_requests", families[0].GetName())
+	tenants := map[string]float64{}
+	for _, m := range families[0].GetMetric() {
+		assert.Equal(t, "tenant", m.GetLabel()[0].GetName())
+		tenants[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+	}
+	assert.Equal(t, map[string]float64{"acme": 2, "initech": 3}, tenants)
+	assert.Equal(t, "uptime", families[1].GetName(), "names without a tenant segment should pass through")
+	assert.Empty(t, families[1].GetMetric()[0].GetLabel())
+}
+
+func TestTenantSegmentNotLast(t *testing.T) {
+	for _, tc := range []struct {
+		index int
+		name  string
+	}{
+		{1, "uptime.seconds"},
+		{0, "uptime"},
+	} {
+		prometheusRegistry := prometheus.NewRegistry()
+		metricsRegistry := metrics.NewRegistry()
+		pClient, _ := NewPrometheusProvider(metricsRegistry, "", "", prometheusRegistry, FlushRate(1*time.Second), TenantSegment(tc.index))
+		metricsRegistry.Register(tc.name, metrics.NewGauge())
+
+		families, err := pClient.FlushAndGather()
+		assert.NoError(t, err)
+		assert.Equal(t, strings.Replace(tc.name, ".", "_", -1), families[0].GetName(), "the last segment should never become the tenant")
+		assert.Empty(t, families[0].GetMetric()[0].GetLabel())
+	}
+}
+
+// customTimer is a third party metric type implementing metrics.Timer.
+type customTimer struct {
+	metrics.Timer
+}
+
+func TestDefaultMetricConverterCustomTimer(t *testing.T) {
+	tm := customTimer{metrics.NewTimer()}
+	defer tm.Stop()
+	tm.Update(time.Second)
+
+	var i interface{} = tm
+	_, isHistogram := i.(metrics.Histogram)
+	_, isMeter := i.(metrics.Meter)
+	assert.False(t, isHistogram || isMeter, "custom timer should only implement metrics.Timer")
+
+	value, err := DefaultMetricConverter("timer", tm)
+	assert.NoError(t, err)
+	assert.Equal(t, tm.Snapshot().Rate1(), value, "custom timer should be converted as a timer")
+}
+
+// queueDepth is a custom metric type implementing none of the go-metrics
+// interfaces.
+type queueDepth []string
+
+func (q queueDepth) PrometheusValue() (float64, error) {
+	return float64(len(q)), nil
+}
+
+func TestPrometheusValuer(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+
+	assert.NoError(t, pClient.ExportMetric("queue.depth", queueDepth{"a", "b", "c"}))
+	families, _ := prometheusRegistry.Gather()
+	assert.Equal(t, "test_subsys_queue_depth", families[0].GetName())
+	assert.Equal(t, 3.0, families[0].GetMetric()[0].GetGauge().GetValue())
+}
+
+func TestGaugeFuncs(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	var calls int
+	_, err := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheusRegistry, GaugeFuncs(map[string]func() float64{
+		"lazy.value": func() float64 {
+			calls++
+			return 42
+		},
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, calls, "function should only be called on collection")
+
+	families, err := prometheusRegistry.Gather()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, "test_subsys_lazy_value", families[0].GetName())
+	assert.Equal(t, 42.0, families[0].GetMetric()[0].GetGauge().GetValue())
+	prometheusRegistry.Gather()
+	assert.Equal(t, 2, calls)
+}
+
+func TestStaleThreshold(t *testing.T) {
+	pClient, _ := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry(), FlushRate(10*time.Second))
+	assert.Equal(t, 20*time.Second, pClient.StaleThreshold(), "default threshold should be twice the flush interval")
+
+	pClient, _ = NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry(), FlushRate(10*time.Second), StaleMultiplier(3.5))
+	assert.Equal(t, 35*time.Second, pClient.StaleThreshold())
+
+	pClient, _ = NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry(), FlushRate(10*time.Second), StaleAfter(time.Minute))
+	assert.Equal(t, time.Minute, pClient.StaleThreshold(), "explicit threshold should win")
+
+	pClient, _ = NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry(), FlushRate(10*time.Second),
+		FlushIntervalFunc(func() time.Duration { return 5 * time.Second }))
+	assert.Equal(t, 10*time.Second, pClient.StaleThreshold(), "the interval of FlushIntervalFunc should be used")
+
+	pClient, _ = NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry(), FlushRate(10*time.Second))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pClient.SetFlushInterval(time.Second)
+	}()
+	pClient.StaleThreshold()
+	<-done
+	assert.Equal(t, 2*time.Second, pClient.StaleThreshold(), "a changed flush interval should be used")
+}
+
+func TestMarkStale(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(10*time.Millisecond), MarkStale(true))
+	metricsRegistry.Register("kept", metrics.NewCounter())
+	metricsRegistry.Register("removed", metrics.NewCounter())
+	pClient.UpdatePrometheusMetricsOnce()
+	metricsRegistry.Unregister("removed")
+
+	families, _ := pClient.FlushAndGather()
+	assert.Equal(t, 2, len(families), "metric should be kept until it is stale")
+	time.Sleep(30 * time.Millisecond)
+	families, _ = pClient.FlushAndGather()
+	assert.Equal(t, 1, len(families), "stale metric should be removed")
+	assert.Equal(t, "test_subsys_kept", families[0].GetName())
+}
+
+func TestRemoveStaleMetrics(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), RemoveStaleMetrics(true))
+	metricsRegistry.Register("kept", metrics.NewGauge())
+	metricsRegistry.Register("removed", metrics.NewGauge())
+	families, _ := pClient.FlushAndGather()
+	assert.Equal(t, 2, len(families))
+
+	metricsRegistry.Unregister("removed")
+	families, _ = pClient.FlushAndGather()
+	assert.Equal(t, 1, len(families), "unregistered metric should be removed by the next flush")
+	assert.Equal(t, "test_subsys_kept", families[0].GetName())
+
+	metricsRegistry.Register("removed", metrics.NewGauge())
+	families, _ = pClient.FlushAndGather()
+	assert.Equal(t, 2, len(families), "metric registered again should be exported again")
+}
+
+func TestRemoveStaleDerivedSeries(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		RemoveStaleMetrics(true), MeterSeries("rate1", "count"), HistogramStats(true), SecondsSinceUpdate(true))
+	meter := metrics.NewMeter()
+	defer meter.Stop()
+	metricsRegistry.Register("requests", meter)
+	metricsRegistry.Register("sizes", metrics.NewHistogram(metrics.NewUniformSample(10)))
+	metricsRegistry.Register("kept", metrics.NewGauge())
+	families, _ := pClient.FlushAndGather()
+	assert.True(t, len(families) > 4, "every derived series should be exported")
+
+	metricsRegistry.Unregister("requests")
+	metricsRegistry.Unregister("sizes")
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	var names []string
+	for _, mf := range families {
+		names = append(names, mf.GetName())
+	}
+	assert.Equal(t, []string{"test_subsys_kept", "test_subsys_kept_seconds_since_update"}, names, "the derived series should be removed along with their metric")
+	assert.Empty(t, pClient.derived["test_subsys_requests"])
+
+	metricsRegistry.Unregister("kept")
+	families, _ = pClient.FlushAndGather()
+	assert.Empty(t, families, "the seconds since update gauge should be removed along with its gauge")
+}
+
+func TestRecoverPanicsKeepsOtherMetrics(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	converter := func(name string, i interface{}) (float64, error) {
+		if name == "metric_3" {
+			panic("broken metric")
+		}
+		return DefaultMetricConverter(name, i)
+	}
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		Converter(converter), RecoverPanics(true))
+	for i := 1; i <= 5; i++ {
+		metricsRegistry.Register(fmt.Sprintf("metric_%d", i), metrics.NewCounter())
+	}
+
+	assert.NotPanics(t, func() { pClient.UpdatePrometheusMetricsOnce() })
+	families, _ := prometheusRegistry.Gather()
+	var names []string
+	for _, mf := range families {
+		names = append(names, mf.GetName())
+	}
+	assert.Equal(t, []string{"test_subsys_metric_1", "test_subsys_metric_2", "test_subsys_metric_4", "test_subsys_metric_5"}, names)
+}
+
+func TestRecoverPanicsWhileCollecting(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var failed []string
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), RecoverPanics(true),
+		LabelParser(func(name string) (string, prometheus.Labels) {
+			if name == "broken" {
+				panic("broken name")
+			}
+			return name, nil
+		}),
+		OnError(func(name string, err error) { failed = append(failed, name) }))
+	metricsRegistry.Register("broken", metrics.NewGauge())
+	metricsRegistry.Register("working", metrics.NewGauge())
+
+	var err error
+	assert.NotPanics(t, func() { err = pClient.UpdatePrometheusMetricsOnce() })
+	assert.Error(t, err)
+	assert.Equal(t, []string{"broken"}, failed, "the panic should be reported")
+	families, _ := prometheusRegistry.Gather()
+	assert.Len(t, families, 1)
+	assert.Equal(t, "test_subsys_working", families[0].GetName())
+}
+
+func TestExportEWMA(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+	ewma := metrics.NewEWMA1()
+	ewma.Update(300)
+	ewma.Tick()
+
+	assert.NoError(t, pClient.ExportMetric("requests", ewma))
+	families, _ := prometheusRegistry.Gather()
+	assert.Equal(t, "test_subsys_requests", families[0].GetName())
+	assert.InDelta(t, 60.0, families[0].GetMetric()[0].GetGauge().GetValue(), 1e-9, "the rate of the EWMA should be exported")
+}
+
+func TestExportMetric(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+	metricsRegistry.Register("other", metrics.NewCounter())
+	cntr := metrics.NewCounter()
+	cntr.Inc(5)
+
+	assert.NoError(t, pClient.ExportMetric("events", cntr))
+	families, _ := prometheusRegistry.Gather()
+	assert.Equal(t, 1, len(families), "only the exported metric should be registered")
+	assert.Equal(t, "test_subsys_events", families[0].GetName())
+	assert.Equal(t, 5.0, families[0].GetMetric()[0].GetCounter().GetValue())
+
+	assert.Error(t, pClient.ExportMetric("healthcheck", metrics.NewHealthcheck(func(metrics.Healthcheck) {})))
+}
+
+func TestComponentNormalization(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "MyService", prometheusRegistry, FlushRate(1*time.Second), KeyNormalizer(LowerCaseKeyNormalizer))
+	metricsRegistry.Register("Counter", metrics.NewCounter())
+	families, _ := pClient.FlushAndGather()
+	assert.Equal(t, "test_MyService_counter", families[0].GetName(), "valid subsystem should be kept as is")
+
+	prometheusRegistry = prometheus.NewRegistry()
+	pClient, _ = NewPrometheusProvider(metricsRegistry, "test", "my.service", prometheusRegistry, FlushRate(1*time.Second))
+	families, _ = pClient.FlushAndGather()
+	assert.Equal(t, "test_my_service_Counter", families[0].GetName(), "invalid subsystem should be normalized")
+
+	prometheusRegistry = prometheus.NewRegistry()
+	pClient, _ = NewPrometheusProvider(metricsRegistry, "test", "MyService", prometheusRegistry, FlushRate(1*time.Second),
+		KeyNormalizer(LowerCaseKeyNormalizer), ComponentNormalizer(strings.ToUpper))
+	families, _ = pClient.FlushAndGather()
+	assert.Equal(t, "TEST_MYSERVICE_counter", families[0].GetName(), "component normalizer should apply to namespace and subsystem")
+}
+
+func TestFlat(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), Flat(true))
+	opts := prometheus.GaugeOpts(pClient.metricOpts("counter", nil))
+	assert.Equal(t, "test_subsys_counter", opts.Name)
+	assert.Empty(t, opts.Namespace)
+	assert.Empty(t, opts.Subsystem)
+
+	metricsRegistry.Register("counter", metrics.NewCounter())
+	families, _ := pClient.FlushAndGather()
+	assert.Equal(t, "test_subsys_counter", families[0].GetName())
+}
+
+func BenchmarkFlush(b *testing.B) {
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), FlushRate(1*time.Second))
+	for i := 0; i < 1000; i++ {
+		metricsRegistry.Register(fmt.Sprintf("gauge.%d", i), metrics.NewGauge())
+	}
+	pClient.UpdatePrometheusMetricsOnce()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pClient.UpdatePrometheusMetricsOnce()
+	}
+}
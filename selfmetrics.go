@@ -0,0 +1,48 @@
+package prometheusmetrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// selfMetrics are the metrics the provider exports about itself when
+// SelfMetrics is enabled.
+type selfMetrics struct {
+	sourceRegistrySize  prometheus.Gauge
+	lastFlushSuccessful prometheus.Gauge
+	flushDuration       prometheus.Gauge
+	flushMetrics        prometheus.Counter
+	flushErrors         prometheus.Counter
+	lastFlushTimestamp  prometheus.Gauge
+}
+
+func newSelfMetrics(c *PrometheusConfig) (*selfMetrics, error) {
+	s := &selfMetrics{
+		sourceRegistrySize:  c.selfGauge("source_registry_size", "Number of metrics in the go-metrics registry at the last flush."),
+		lastFlushSuccessful: c.selfGauge("exporter_last_flush_successful", "Whether the last flush exported every metric without errors."),
+		flushDuration:       c.selfGauge("flush_duration_seconds", "Time spent in the last flush."),
+		flushMetrics:        c.selfCounter("flush_metrics_total", "Number of go-metrics metrics scanned by the flushes."),
+		flushErrors:         c.selfCounter("flush_errors_total", "Number of metrics the flushes failed to convert or register."),
+		lastFlushTimestamp:  c.selfGauge("last_flush_timestamp_seconds", "Unix time the last flush ended at."),
+	}
+	for _, g := range []prometheus.Collector{s.sourceRegistrySize, s.lastFlushSuccessful, s.flushDuration, s.flushMetrics, s.flushErrors, s.lastFlushTimestamp} {
+		if err := c.registerStatic(g); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (c *PrometheusConfig) selfGauge(name, help string) prometheus.Gauge {
+	return prometheus.NewGauge(prometheus.GaugeOpts(c.opts(name, help, c.constLabels)))
+}
+
+func (c *PrometheusConfig) selfCounter(name, help string) prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts(c.opts(name, help, c.constLabels)))
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
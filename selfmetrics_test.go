@@ -0,0 +1,84 @@
+package prometheusmetrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelfMetricsSourceRegistrySize(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, err := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), SelfMetrics(true))
+	assert.NoError(t, err)
+	metricsRegistry.Register("counter", metrics.NewCounter())
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	metricsRegistry.Register("healthcheck", metrics.NewHealthcheck(func(metrics.Healthcheck) {}))
+	pClient.UpdatePrometheusMetricsOnce()
+	assert.Equal(t, 3.0, testutil.ToFloat64(pClient.self.sourceRegistrySize), "registry size should count every source metric")
+
+	metricsRegistry.Unregister("gauge")
+	pClient.UpdatePrometheusMetricsOnce()
+	assert.Equal(t, 2.0, testutil.ToFloat64(pClient.self.sourceRegistrySize))
+}
+
+func TestSelfMetricsSourceRegistrySizeFiltered(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), SelfMetrics(true),
+		MetricFilter(func(name string) bool { return name == "counter" }))
+	metricsRegistry.Register("counter", metrics.NewCounter())
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	metricsRegistry.Register("other", metrics.NewGauge())
+	pClient.UpdatePrometheusMetricsOnce()
+	assert.Equal(t, 3.0, testutil.ToFloat64(pClient.self.sourceRegistrySize), "filtered metrics should still be counted")
+	assert.Equal(t, 1.0, testutil.ToFloat64(pClient.self.flushMetrics), "only the selected metric should be processed")
+}
+
+func TestSelfMetricsLastFlushSuccessful(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), SelfMetrics(true))
+	metricsRegistry.Register("counter", metrics.NewCounter())
+	pClient.UpdatePrometheusMetricsOnce()
+	assert.Equal(t, 1.0, testutil.ToFloat64(pClient.self.lastFlushSuccessful), "flush without errors should be successful")
+
+	metricsRegistry.Register("healthcheck", metrics.NewHealthcheck(func(metrics.Healthcheck) {}))
+	pClient.UpdatePrometheusMetricsOnce()
+	assert.Equal(t, 0.0, testutil.ToFloat64(pClient.self.lastFlushSuccessful), "conversion error should mark the flush as failed")
+}
+
+func TestSelfMetricsFlushStats(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), SelfMetrics(true))
+	metricsRegistry.Register("counter", metrics.NewCounter())
+	metricsRegistry.Register("healthcheck", metrics.NewHealthcheck(func(metrics.Healthcheck) {}))
+	pClient.UpdatePrometheusMetricsOnce()
+	pClient.UpdatePrometheusMetricsOnce()
+
+	assert.Equal(t, 4.0, testutil.ToFloat64(pClient.self.flushMetrics), "every scanned metric should be counted")
+	assert.Equal(t, 2.0, testutil.ToFloat64(pClient.self.flushErrors), "every failed metric should be counted")
+	assert.True(t, testutil.ToFloat64(pClient.self.flushDuration) > 0, "the flush duration should be set")
+}
+
+func TestSelfMetricsLastFlushTimestamp(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), SelfMetrics(true))
+	before := time.Now()
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	var timestamp float64
+	for _, mf := range families {
+		if mf.GetName() == "test_subsys_last_flush_timestamp_seconds" {
+			timestamp = mf.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	assert.InDelta(t, float64(before.Unix()), timestamp, 1, "the timestamp should be prefixed like every other metric and set by the flush")
+}
@@ -0,0 +1,84 @@
+package prometheusmetrics
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+)
+
+// stats is implemented by the snapshots of go-metrics histograms and timers.
+type stats interface {
+	distribution
+	Min() int64
+	Max() int64
+	Mean() float64
+	StdDev() float64
+}
+
+// quantileSuffix returns the suffix of the gauge exported for quantile q,
+// e.g. p50 for 0.5 and p999 for 0.999.
+func quantileSuffix(q float64) string {
+	switch q {
+	case 0:
+		return "p0"
+	case 1:
+		return "p100"
+	}
+	digits := strings.TrimPrefix(strconv.FormatFloat(q, 'f', -1, 64), "0.")
+	if len(digits) == 1 {
+		digits += "0"
+	}
+	return "p" + digits
+}
+
+// statsFromNameAndSnapshot exports the min, max, mean, standard deviation and
+// the given quantiles of a snapshot as gauges suffixed with their statistic.
+// Values are divided by unit, e.g. to convert nanoseconds to seconds.
+func (c *PrometheusConfig) statsFromNameAndSnapshot(name string, snapshot stats, quantiles []float64, unit float64, labels prometheus.Labels) error {
+	values := map[string]float64{
+		"min":    float64(snapshot.Min()) / unit,
+		"max":    float64(snapshot.Max()) / unit,
+		"mean":   snapshot.Mean() / unit,
+		"stddev": snapshot.StdDev() / unit,
+	}
+	for i, p := range percentiles(snapshot, quantiles, c.emptyAsNaN) {
+		values[quantileSuffix(quantiles[i])] = p / unit
+	}
+	return c.gaugesFromNameAndValues(name, values, labels)
+}
+
+// gaugesFromNameAndValues exports each value as a gauge named after name and
+// the suffix the value is keyed by.
+func (c *PrometheusConfig) gaugesFromNameAndValues(name string, values map[string]float64, labels prometheus.Labels) error {
+	for suffix, value := range values {
+		if err := c.gaugeFromNameAndValue(name+"_"+suffix, value, labels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// histogramStatsFromNameAndSnapshot exports the count and statistics of a
+// histogram, all taken from the same snapshot.
+func (c *PrometheusConfig) histogramStatsFromNameAndSnapshot(name string, snapshot metrics.Histogram, labels prometheus.Labels) error {
+	if err := c.gaugeFromNameAndValue(name+"_count", float64(snapshot.Count()), labels); err != nil {
+		return err
+	}
+	return c.statsFromNameAndSnapshot(name, snapshot, c.histogramQuantiles, 1, labels)
+}
+
+// timerStatsFromNameAndSnapshot exports the statistics and rates of a timer,
+// all taken from the same snapshot.
+func (c *PrometheusConfig) timerStatsFromNameAndSnapshot(name string, snapshot metrics.Timer, labels prometheus.Labels) error {
+	if err := c.statsFromNameAndSnapshot(name, snapshot, c.timerQuantiles, float64(c.timerUnit), labels); err != nil || c.warmingUp() {
+		return err
+	}
+	return c.gaugesFromNameAndValues(name, map[string]float64{
+		"rate1":     snapshot.Rate1(),
+		"rate5":     snapshot.Rate5(),
+		"rate15":    snapshot.Rate15(),
+		"rate_mean": snapshot.RateMean(),
+	}, labels)
+}
@@ -0,0 +1,104 @@
+package prometheusmetrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuantileSuffix(t *testing.T) {
+	for q, suffix := range map[float64]string{0: "p0", 0.5: "p50", 0.9: "p90", 0.95: "p95", 0.999: "p999", 1: "p100"} {
+		assert.Equal(t, suffix, quantileSuffix(q))
+	}
+}
+
+func TestTimerStats(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		TimerStats(true), TimerQuantiles([]float64{0.5, 0.99}), TimerUnit(time.Second))
+	timer := metrics.NewTimer()
+	defer timer.Stop()
+	metricsRegistry.Register("latency", timer)
+	timer.Update(1 * time.Second)
+	timer.Update(3 * time.Second)
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	values := make(map[string]float64)
+	for _, mf := range families {
+		values[mf.GetName()] = mf.GetMetric()[0].GetGauge().GetValue()
+	}
+	assert.Len(t, values, 10)
+	assert.Equal(t, 1.0, values["test_subsys_latency_min"])
+	assert.Equal(t, 3.0, values["test_subsys_latency_max"])
+	assert.Equal(t, 2.0, values["test_subsys_latency_mean"])
+	assert.Equal(t, 1.0, values["test_subsys_latency_stddev"])
+	assert.Equal(t, 2.0, values["test_subsys_latency_p50"])
+	assert.Equal(t, 3.0, values["test_subsys_latency_p99"])
+	assert.Contains(t, values, "test_subsys_latency_rate1")
+	assert.Contains(t, values, "test_subsys_latency_rate_mean")
+}
+
+func TestHistogramStats(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		HistogramStats(true), HistogramQuantiles([]float64{0.5, 0.9}))
+	histogram := metrics.NewHistogram(metrics.NewUniformSample(100))
+	metricsRegistry.Register("size", histogram)
+	for i := int64(1); i <= 10; i++ {
+		histogram.Update(i)
+	}
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	values := make(map[string]float64)
+	for _, mf := range families {
+		values[mf.GetName()] = mf.GetMetric()[0].GetGauge().GetValue()
+	}
+	assert.Equal(t, map[string]float64{
+		"test_subsys_size_count":  10,
+		"test_subsys_size_min":    1,
+		"test_subsys_size_max":    10,
+		"test_subsys_size_mean":   5.5,
+		"test_subsys_size_stddev": histogram.Snapshot().StdDev(),
+		"test_subsys_size_p50":    5.5,
+		"test_subsys_size_p90":    histogram.Snapshot().Percentile(0.9),
+	}, values)
+}
+
+func TestTimerStatsConsistentUnderUpdates(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), TimerStats(true))
+	timer := metrics.NewTimer()
+	defer timer.Stop()
+	metricsRegistry.Register("latency", timer)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20000; i++ {
+			timer.Update(time.Duration(i%1000) * time.Millisecond)
+		}
+	}()
+	for flushing := true; flushing; {
+		select {
+		case <-done:
+			flushing = false
+		default:
+		}
+		families, _ := pClient.FlushAndGather()
+		values := make(map[string]float64)
+		for _, mf := range families {
+			values[mf.GetName()] = mf.GetMetric()[0].GetGauge().GetValue()
+		}
+		assert.True(t, values["test_subsys_latency_min"] <= values["test_subsys_latency_p50"], "min should not exceed p50: %v", values)
+		assert.True(t, values["test_subsys_latency_p50"] <= values["test_subsys_latency_p99"], "p50 should not exceed p99: %v", values)
+		assert.True(t, values["test_subsys_latency_p99"] <= values["test_subsys_latency_max"], "p99 should not exceed max: %v", values)
+	}
+}
@@ -0,0 +1,89 @@
+package prometheusmetrics
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultSummaryObjectives are the quantile objectives used for exported
+// summaries unless SummaryObjectives is given.
+var DefaultSummaryObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+
+// summaryCollector exposes the percentiles of a go-metrics timer or histogram
+// as a Prometheus summary. The quantiles are taken from the objectives of the
+// summary options and recomputed on every flush.
+type summaryCollector struct {
+	desc      *prometheus.Desc
+	quantiles []float64
+
+	mu     sync.Mutex
+	count  uint64
+	sum    float64
+	values map[float64]float64
+}
+
+func newSummaryCollector(opts prometheus.SummaryOpts) *summaryCollector {
+	quantiles := make([]float64, 0, len(opts.Objectives))
+	for q := range opts.Objectives {
+		quantiles = append(quantiles, q)
+	}
+	sort.Float64s(quantiles)
+	return &summaryCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+			opts.Help, nil, opts.ConstLabels,
+		),
+		quantiles: quantiles,
+		values:    make(map[float64]float64, len(quantiles)),
+	}
+}
+
+// distribution is implemented by the go-metrics types that can be exported
+// as a summary, i.e. histograms and timers.
+type distribution interface {
+	Count() int64
+	Sum() int64
+	Percentiles([]float64) []float64
+}
+
+// percentiles returns the given percentiles of a snapshot. For an empty
+// snapshot they are all NaN if nanIfEmpty is set, and 0 otherwise.
+func percentiles(snapshot distribution, quantiles []float64, nanIfEmpty bool) []float64 {
+	if snapshot.Count() == 0 && nanIfEmpty {
+		values := make([]float64, len(quantiles))
+		for i := range values {
+			values[i] = math.NaN()
+		}
+		return values
+	}
+	return snapshot.Percentiles(quantiles)
+}
+
+// update replaces the exported state with the given snapshot.
+func (s *summaryCollector) update(snapshot distribution, nanIfEmpty bool) {
+	percentiles := percentiles(snapshot, s.quantiles, nanIfEmpty)
+	values := make(map[float64]float64, len(s.quantiles))
+	for i, q := range s.quantiles {
+		values[q] = percentiles[i]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.count = uint64(snapshot.Count())
+	s.sum = float64(snapshot.Sum())
+	s.values = values
+}
+
+func (s *summaryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.desc
+}
+
+func (s *summaryCollector) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	m := prometheus.MustNewConstSummary(s.desc, s.count, s.sum, s.values)
+	s.mu.Unlock()
+	ch <- m
+}
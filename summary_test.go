@@ -0,0 +1,44 @@
+package prometheusmetrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimerSummaryObjectives(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		TimerSummaries(true), SummaryObjectives(map[float64]float64{0.75: 0.01, 0.999: 0.0001}))
+	tm := metrics.NewTimer()
+	metricsRegistry.Register("timer", tm)
+	tm.Update(10 * time.Millisecond)
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, err := prometheusRegistry.Gather()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(families), "prometheus was unable to register the metric")
+	summary := families[0].GetMetric()[0].GetSummary()
+	assert.Equal(t, uint64(1), summary.GetSampleCount())
+	var quantiles []float64
+	for _, q := range summary.GetQuantile() {
+		quantiles = append(quantiles, q.GetQuantile())
+	}
+	assert.Equal(t, []float64{0.75, 0.999}, quantiles, "configured objectives should be exported")
+}
+
+func TestTimerSummaryDefaultObjectives(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), TimerSummaries(true))
+	metricsRegistry.Register("timer", metrics.NewTimer())
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	assert.Equal(t, 1, len(families), "prometheus was unable to register the metric")
+	assert.Equal(t, len(DefaultSummaryObjectives), len(families[0].GetMetric()[0].GetSummary().GetQuantile()))
+}
@@ -0,0 +1,91 @@
+package prometheusmetrics
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rcrowley/go-metrics"
+)
+
+// TestingT is the subset of *testing.T used by TestProvider.
+type TestingT interface {
+	Errorf(format string, args ...interface{})
+}
+
+// TestProvider exports a fresh go-metrics registry to a fresh Prometheus
+// registry, for packages testing their instrumentation.
+type TestProvider struct {
+	*PrometheusConfig
+	Metrics    metrics.Registry
+	Prometheus *prometheus.Registry
+}
+
+// NewTestProvider returns a TestProvider without namespace and subsystem.
+// It panics if one of the options is invalid.
+func NewTestProvider(setters ...optSetter) *TestProvider {
+	p := &TestProvider{
+		Metrics:    metrics.NewRegistry(),
+		Prometheus: prometheus.NewRegistry(),
+	}
+	c, err := NewPrometheusProvider(p.Metrics, "", "", p.Prometheus, setters...)
+	if err != nil {
+		panic(err)
+	}
+	p.PrometheusConfig = c
+	return p
+}
+
+// Value flushes the registry and returns the value of the single series
+// exported for the go-metrics metric name.
+func (p *TestProvider) Value(name string) (float64, error) {
+	families, err := p.FlushAndGather()
+	if err != nil {
+		return 0, err
+	}
+	fqName := p.name(name)
+	for _, mf := range families {
+		if mf.GetName() != fqName {
+			continue
+		}
+		if len(mf.GetMetric()) != 1 {
+			return 0, fmt.Errorf("metric '%s' has %d series", fqName, len(mf.GetMetric()))
+		}
+		return value(mf.GetMetric()[0])
+	}
+	return 0, fmt.Errorf("metric '%s' is not exported", fqName)
+}
+
+// AssertMetric flushes the registry and reports an error to t unless the
+// metric name was exported with the expected value.
+func (p *TestProvider) AssertMetric(t TestingT, name string, expected float64) bool {
+	actual, err := p.Value(name)
+	if err != nil {
+		t.Errorf("%s", err)
+		return false
+	}
+	if actual != expected {
+		t.Errorf("metric '%s' has value %g, expected %g", p.name(name), actual, expected)
+		return false
+	}
+	return true
+}
+
+// name returns the fully qualified name exported for name.
+func (p *TestProvider) name(name string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.fqName(name)
+}
+
+func value(m *dto.Metric) (float64, error) {
+	switch {
+	case m.Gauge != nil:
+		return m.GetGauge().GetValue(), nil
+	case m.Counter != nil:
+		return m.GetCounter().GetValue(), nil
+	case m.Untyped != nil:
+		return m.GetUntyped().GetValue(), nil
+	}
+	return 0, fmt.Errorf("metric '%s' has no single value", m.String())
+}
@@ -0,0 +1,34 @@
+package prometheusmetrics
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingT struct {
+	errors []string
+}
+
+func (t *recordingT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestTestProvider(t *testing.T) {
+	p := NewTestProvider()
+	counter := metrics.NewCounter()
+	p.Metrics.Register("requests.served", counter)
+	counter.Inc(3)
+
+	assert.True(t, p.AssertMetric(t, "requests.served", 3))
+
+	recorder := &recordingT{}
+	assert.False(t, p.AssertMetric(recorder, "requests.served", 4))
+	assert.False(t, p.AssertMetric(recorder, "requests.missing", 0))
+	assert.Equal(t, []string{
+		"metric 'requests_served' has value 3, expected 4",
+		"metric 'requests_missing' is not exported",
+	}, recorder.errors)
+}
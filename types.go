@@ -0,0 +1,276 @@
+package prometheusmetrics
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+)
+
+// PromType is the type of Prometheus metric a go-metrics metric is exported
+// as.
+type PromType int
+
+const (
+	GaugeType PromType = iota
+	CounterType
+	HistogramType
+	SummaryType
+	UntypedType
+)
+
+func (t PromType) String() string {
+	switch t {
+	case GaugeType:
+		return "gauge"
+	case CounterType:
+		return "counter"
+	case HistogramType:
+		return "histogram"
+	case SummaryType:
+		return "summary"
+	case UntypedType:
+		return "untyped"
+	}
+	return "unknown"
+}
+
+// PromTypeResolver returns the type of Prometheus metric a go-metrics metric
+// is exported as.
+type PromTypeResolver func(name string, metric interface{}) PromType
+
+type pendingKind struct {
+	kind    PromType
+	flushes int
+}
+
+// promTypeOf returns the type a metric is exported as with the current
+// configuration.
+func (c *PrometheusConfig) promTypeOf(name string, i interface{}) PromType {
+	if c.typeResolver != nil {
+		return c.typeResolver(name, i)
+	}
+	switch i.(type) {
+	case metrics.Counter:
+		if !c.countersAsGauges {
+			return CounterType
+		}
+	case metrics.Histogram:
+		if c.histogramBuckets != nil || c.defaultBuckets != nil {
+			return HistogramType
+		}
+	case metrics.Timer:
+		if c.timerSummaries {
+			return SummaryType
+		}
+	}
+	return GaugeType
+}
+
+// stableKind reports whether a metric can be exported as kind. A metric that
+// changed its type is only re-registered once the new type was seen for
+// kindStableAfter consecutive flushes.
+func (c *PrometheusConfig) stableKind(key string, kind PromType) bool {
+	current, ok := c.kinds[key]
+	if !ok {
+		c.kinds[key] = kind
+		return true
+	}
+	if current == kind {
+		delete(c.pendingKinds, key)
+		return true
+	}
+
+	pending, ok := c.pendingKinds[key]
+	if !ok || pending.kind != kind {
+		pending = &pendingKind{kind: kind}
+		c.pendingKinds[key] = pending
+	}
+	pending.flushes++
+	if pending.flushes < c.kindStableAfter {
+		return false
+	}
+
+	delete(c.pendingKinds, key)
+	c.removeCollector(key, current)
+	c.kinds[key] = kind
+	return true
+}
+
+// removeCollector unregisters the collector exported under key as kind, and
+// every collector derived from it.
+func (c *PrometheusConfig) removeCollector(key string, kind PromType) {
+	delete(c.changes, key)
+	var collector prometheus.Collector
+	switch kind {
+	case GaugeType:
+		if g, ok := c.gauges[key]; ok {
+			collector = g
+			delete(c.gauges, key)
+		}
+		if v, ok := c.gaugeVecs[key]; ok {
+			collector = v
+			delete(c.gaugeVecs, key)
+		}
+		if s, ok := c.vecSeries[key]; ok {
+			s.vec.DeleteLabelValues(s.values...)
+			delete(c.vecSeries, key)
+		}
+	case CounterType:
+		if cn, ok := c.counters[key]; ok {
+			collector = cn
+			delete(c.counters, key)
+			delete(c.counterTotal, key)
+			delete(c.created, key)
+		}
+	case HistogramType:
+		if h, ok := c.histograms[key]; ok {
+			collector = h
+			delete(c.histograms, key)
+		}
+	case SummaryType:
+		if s, ok := c.summaries[key]; ok {
+			collector = s
+			delete(c.summaries, key)
+		}
+	case UntypedType:
+		if u, ok := c.untyped[key]; ok {
+			collector = u
+			delete(c.untyped, key)
+		}
+	}
+	if collector != nil {
+		c.unregister(collector)
+	}
+	for derivedKey, derivedKind := range c.derived[key] {
+		c.removeCollector(derivedKey, derivedKind)
+	}
+	delete(c.derived, key)
+}
+
+// derive records that the collector exported under key belongs to the metric
+// being exported, e.g. a series of a meter exported with MeterSeries, so it
+// is removed along with that metric.
+func (c *PrometheusConfig) derive(key string, kind PromType) {
+	if c.exporting == "" || key == c.exporting {
+		return
+	}
+	keys, ok := c.derived[c.exporting]
+	if !ok {
+		keys = make(map[string]PromType)
+		c.derived[c.exporting] = keys
+	}
+	keys[key] = kind
+}
+
+// counterFromNameAndValue advances a Prometheus counter to val. Prometheus
+// counters can only go up, so when val drops below the last exported value
+// the source was reset and the counter is registered anew. Negative values,
+// e.g. of a go-metrics counter decremented below zero, cannot be exported as
+// a counter at all.
+func (c *PrometheusConfig) counterFromNameAndValue(name string, val float64, labels prometheus.Labels) error {
+	if val < 0 {
+		return fmt.Errorf("metric '%s' has negative value %g and cannot be exported as a counter", name, val)
+	}
+	key := c.metricKey(name, labels)
+	cn, ok := c.counters[key]
+	if ok && val < c.counterTotal[key] {
+		c.unregister(cn)
+		ok = false
+	}
+	if !ok {
+		collector, err := c.register(name, prometheus.NewCounter(prometheus.CounterOpts(c.metricOpts(name, labels))))
+		if err != nil {
+			return err
+		}
+		cn = collector.(prometheus.Counter)
+		c.counters[key] = cn
+		c.derive(key, CounterType)
+		c.counterTotal[key] = 0
+	}
+	cn.Add(val - c.counterTotal[key])
+	c.counterTotal[key] = val
+	changed := c.trackChange(name, val, labels)
+	if c.sinceUpdate {
+		return c.setGauge(name+"_seconds_since_update", time.Since(changed).Seconds(), labels)
+	}
+	return nil
+}
+
+// meterCounterFromNameAndSnapshot exports the count of a meter as a counter
+// and, as a gauge, the time the counter was started at, which is reset along
+// with the counter.
+func (c *PrometheusConfig) meterCounterFromNameAndSnapshot(name string, snapshot metrics.Meter, labels prometheus.Labels) error {
+	totalName := name + "_total"
+	key := c.metricKey(totalName, labels)
+	count := float64(snapshot.Count())
+	created, ok := c.created[key]
+	if total, seen := c.counterTotal[key]; !ok || !seen || count < total {
+		created = time.Now()
+		c.created[key] = created
+	}
+	if err := c.counterFromNameAndValue(totalName, count, labels); err != nil {
+		return err
+	}
+	return c.gaugeFromNameAndValue(name+"_start_time_seconds", float64(created.UnixNano())/1e9, labels)
+}
+
+// ResetCounters forgets the values the native Prometheus counters were
+// advanced to. As Prometheus counters cannot decrease, every counter series
+// is unregistered and registered anew by the next flush, starting from the
+// current value of its go-metrics metric.
+func (c *PrometheusConfig) ResetCounters() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, cn := range c.counters {
+		c.unregister(cn)
+		delete(c.counters, key)
+		delete(c.counterTotal, key)
+	}
+}
+
+func (c *PrometheusConfig) untypedFromNameAndValue(name string, val float64, labels prometheus.Labels) error {
+	key := c.metricKey(name, labels)
+	u, ok := c.untyped[key]
+	if !ok {
+		collector, err := c.register(name, &untypedCollector{desc: prometheus.NewDesc(
+			c.fqName(name),
+			name, nil, labels,
+		)})
+		if err != nil {
+			return err
+		}
+		u = collector.(*untypedCollector)
+		c.untyped[key] = u
+		c.derive(key, UntypedType)
+	}
+	u.set(val)
+	return nil
+}
+
+// untypedCollector exposes a single value as an untyped Prometheus metric.
+type untypedCollector struct {
+	desc *prometheus.Desc
+
+	mu    sync.Mutex
+	value float64
+}
+
+func (u *untypedCollector) set(val float64) {
+	u.mu.Lock()
+	u.value = val
+	u.mu.Unlock()
+}
+
+func (u *untypedCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- u.desc
+}
+
+func (u *untypedCollector) Collect(ch chan<- prometheus.Metric) {
+	u.mu.Lock()
+	m := prometheus.MustNewConstMetric(u.desc, prometheus.UntypedValue, u.value)
+	u.mu.Unlock()
+	ch <- m
+}
@@ -0,0 +1,288 @@
+package prometheusmetrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypeResolver(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	resolver := func(_ string, i interface{}) PromType {
+		switch i.(type) {
+		case metrics.Counter:
+			return CounterType
+		case metrics.Histogram:
+			return HistogramType
+		}
+		return GaugeType
+	}
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), TypeResolver(resolver))
+	cntr := metrics.NewCounter()
+	hist := metrics.NewHistogram(metrics.NewUniformSample(10))
+	metricsRegistry.Register("counter", cntr)
+	metricsRegistry.Register("histogram", hist)
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	cntr.Inc(3)
+	hist.Update(1)
+	pClient.UpdatePrometheusMetricsOnce()
+	cntr.Inc(4)
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, err := prometheusRegistry.Gather()
+	assert.NoError(t, err)
+	types := map[string]string{}
+	for _, mf := range families {
+		types[mf.GetName()] = mf.GetType().String()
+	}
+	assert.Equal(t, map[string]string{
+		"test_subsys_counter":   "COUNTER",
+		"test_subsys_histogram": "HISTOGRAM",
+		"test_subsys_gauge":     "GAUGE",
+	}, types)
+	for _, mf := range families {
+		if mf.GetName() == "test_subsys_counter" {
+			assert.Equal(t, 7.0, mf.GetMetric()[0].GetCounter().GetValue())
+		}
+	}
+}
+
+func TestCounterTypeReset(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		TypeResolver(func(string, interface{}) PromType { return CounterType }))
+	cntr := metrics.NewCounter()
+	metricsRegistry.Register("counter", cntr)
+	cntr.Inc(10)
+	pClient.UpdatePrometheusMetricsOnce()
+	cntr.Clear()
+	cntr.Inc(2)
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	assert.Equal(t, 1, len(families), "prometheus was unable to register the metric")
+	assert.Equal(t, 2.0, families[0].GetMetric()[0].GetCounter().GetValue(), "counter should restart after a reset")
+}
+
+func TestClearedCounterResets(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second))
+	cntr := metrics.NewCounter()
+	metricsRegistry.Register("counter", cntr)
+	cntr.Inc(10)
+	families, _ := pClient.FlushAndGather()
+	assert.Equal(t, 10.0, families[0].GetMetric()[0].GetCounter().GetValue())
+
+	cntr.Clear()
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, families[0].GetMetric()[0].GetCounter().GetValue(), "a cleared counter should restart from zero")
+	cntr.Inc(3)
+	families, err = pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(families))
+	assert.Equal(t, 3.0, families[0].GetMetric()[0].GetCounter().GetValue(), "the restarted counter should count from the reset")
+	assert.Equal(t, 3.0, pClient.counterTotal["test_subsys_counter"], "the value after the reset should be the new baseline")
+}
+
+func TestConcurrentCounterFlushes(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		TypeResolver(func(string, interface{}) PromType { return CounterType }))
+	cntr := metrics.NewCounter()
+	metricsRegistry.Register("counter", cntr)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			cntr.Inc(1)
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var last float64
+			for j := 0; j < 50; j++ {
+				families, _ := pClient.FlushAndGather()
+				value := families[0].GetMetric()[0].GetCounter().GetValue()
+				assert.True(t, value >= last, "exported total should not decrease")
+				last = value
+			}
+		}()
+	}
+	wg.Wait()
+	<-done
+
+	families, _ := pClient.FlushAndGather()
+	assert.Equal(t, 1000.0, families[0].GetMetric()[0].GetCounter().GetValue(), "every increment should be counted exactly once")
+}
+
+func TestTypeFromNameSuffix(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), TypeFromNameSuffix(true))
+	metricsRegistry.Register("requests.counter", metrics.NewCounter())
+	metricsRegistry.Register("queue.gauge", metrics.NewCounter())
+	metricsRegistry.Register("sizes.histogram", metrics.NewHistogram(metrics.NewUniformSample(10)))
+	metricsRegistry.Register("latency.timer", metrics.NewGauge())
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	types := make(map[string]string)
+	for _, mf := range families {
+		types[mf.GetName()] = mf.GetType().String()
+	}
+	assert.Equal(t, map[string]string{
+		"test_subsys_requests":      "COUNTER",
+		"test_subsys_queue":         "GAUGE",
+		"test_subsys_sizes":         "HISTOGRAM",
+		"test_subsys_latency_timer": "GAUGE",
+	}, types)
+}
+
+func TestMeterSeries(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		MeterSeries("rate1", "rate5", "rate15", "mean", "count"))
+	meter := metrics.NewMeter()
+	defer meter.Stop()
+	metricsRegistry.Register("requests", meter)
+	meter.Mark(7)
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	types := make(map[string]string)
+	for _, mf := range families {
+		types[mf.GetName()] = mf.GetType().String()
+	}
+	assert.Equal(t, map[string]string{
+		"test_subsys_requests_count":  "COUNTER",
+		"test_subsys_requests_mean":   "GAUGE",
+		"test_subsys_requests_rate1":  "GAUGE",
+		"test_subsys_requests_rate15": "GAUGE",
+		"test_subsys_requests_rate5":  "GAUGE",
+	}, types)
+	assert.Equal(t, 7.0, families[0].GetMetric()[0].GetCounter().GetValue())
+
+	_, err = NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, MeterSeries("rate2"))
+	assert.Error(t, err)
+}
+
+func TestTimerCounts(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), TimerCounts(true))
+	timer := metrics.NewTimer()
+	metricsRegistry.Register("latency", timer)
+	timer.Update(time.Millisecond)
+	timer.Update(time.Millisecond)
+
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	types := make(map[string]string)
+	for _, mf := range families {
+		types[mf.GetName()] = mf.GetType().String()
+	}
+	assert.Equal(t, map[string]string{
+		"test_subsys_latency":       "GAUGE",
+		"test_subsys_latency_count": "COUNTER",
+	}, types, "the rate should stay exported next to the count")
+	assert.Equal(t, 2.0, families[1].GetMetric()[0].GetCounter().GetValue())
+}
+
+func TestNegativeCounter(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), TypeFromNameSuffix(true))
+	cntr := metrics.NewCounter()
+	metricsRegistry.Register("inflight", cntr)
+	gauge := metrics.NewGauge()
+	metricsRegistry.Register("x.counter", gauge)
+	cntr.Dec(1)
+	gauge.Update(-5)
+
+	var err error
+	assert.NotPanics(t, func() { err = pClient.UpdatePrometheusMetricsOnce() }, "negative counters should not panic")
+	assert.Error(t, err, "negative counters should fail to export")
+	families, _ := prometheusRegistry.Gather()
+	assert.Empty(t, families)
+
+	cntr.Inc(3)
+	gauge.Update(4)
+	families, err = pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(families))
+	assert.Equal(t, 2.0, families[0].GetMetric()[0].GetCounter().GetValue(), "the counter should be exported once it is positive")
+	assert.Equal(t, 4.0, families[1].GetMetric()[0].GetCounter().GetValue())
+}
+
+func TestResetCounters(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second),
+		TypeResolver(func(string, interface{}) PromType { return CounterType }))
+	cntr := metrics.NewCounter()
+	metricsRegistry.Register("counter", cntr)
+	cntr.Inc(10)
+	pClient.UpdatePrometheusMetricsOnce()
+
+	pClient.ResetCounters()
+	families, _ := prometheusRegistry.Gather()
+	assert.Empty(t, families, "counters should be unregistered by a reset")
+	assert.Empty(t, pClient.counterTotal, "delta baseline should be cleared")
+
+	cntr.Clear()
+	cntr.Inc(4)
+	families, err := pClient.FlushAndGather()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(families))
+	assert.Equal(t, 4.0, families[0].GetMetric()[0].GetCounter().GetValue(), "counter should restart from the new baseline")
+}
+
+func TestMeterCounters(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient, _ := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, FlushRate(1*time.Second), MeterCounters(true))
+	meter := metrics.NewMeter()
+	defer meter.Stop()
+	metricsRegistry.Register("requests", meter)
+	meter.Mark(3)
+	before := time.Now()
+	pClient.UpdatePrometheusMetricsOnce()
+	meter.Mark(2)
+	pClient.UpdatePrometheusMetricsOnce()
+
+	server := httptest.NewServer(pClient.Handler())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "# TYPE test_subsys_requests_total counter\ntest_subsys_requests_total 5\n")
+	assert.Contains(t, string(body), "# TYPE test_subsys_requests_start_time_seconds gauge\n", "the start time should be a gauge of its own")
+	assert.NotContains(t, string(body), "_created", "the suffix of OpenMetrics created samples should not be used")
+	assert.NotContains(t, string(body), "# TYPE test_subsys_requests gauge", "the rate should not be exported")
+
+	families, _ := prometheusRegistry.Gather()
+	for _, mf := range families {
+		if mf.GetName() == "test_subsys_requests_start_time_seconds" {
+			created := mf.GetMetric()[0].GetGauge().GetValue()
+			assert.InDelta(t, float64(before.Unix()), created, 1, "created should be the time the meter was first seen")
+		}
+	}
+}